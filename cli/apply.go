@@ -0,0 +1,461 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/marklap/imgdupdetect/datastore"
+	"github.com/marklap/imgdupdetect/fs"
+	"github.com/marklap/imgdupdetect/img"
+	"github.com/marklap/imgdupdetect/index"
+	"github.com/marklap/imgdupdetect/keeper"
+	"github.com/marklap/imgdupdetect/match"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Actions apply can take on the duplicates that are not kept
+const (
+	// ActionDelete deletes the duplicates
+	ActionDelete = "delete"
+	// ActionQuarantine moves the duplicates into a tree under the quarantine directory that
+	// mirrors their original paths
+	ActionQuarantine = "quarantine"
+	// ActionHardlink replaces the duplicates with hard links to the keeper
+	ActionHardlink = "hardlink"
+	// ActionSymlink replaces the duplicates with symbolic links to the keeper
+	ActionSymlink = "symlink"
+)
+
+// Actions are the names of the actions apply can take
+var Actions = []string{ActionDelete, ActionQuarantine, ActionHardlink, ActionSymlink}
+
+// ApplyConfig is the apply CLI config
+type ApplyConfig struct {
+
+	// Datastore is the datastore
+	Datastore *datastore.Datastore
+	// FingerPrintCol is the name of the collection to use for fingerprints
+	FingerPrintCol string
+	// Algorithm is the name of the fingerprint algorithm the collection was built with
+	Algorithm string
+	// Threshold is the number of differing fingerprint bits still considered a duplicate
+	Threshold int
+	// ContentCol is the name of the collection of file content hashes; empty leaves exact copies
+	// to the fingerprint collection
+	ContentCol string
+	// Keep selects the file of each group worth keeping; empty uses keeper.Default
+	Keep keeper.Chain
+	// Action is what is done to the duplicates that are not kept, one of Actions
+	Action string
+	// Quarantine is the directory duplicates are moved to by ActionQuarantine
+	Quarantine string
+	// Stash is the directory the other actions copy a duplicate to before they remove it, when it
+	// is not a byte-identical copy of its keeper, so it can be restored
+	Stash string
+	// DryRun reports what would be done without touching any file
+	DryRun bool
+}
+
+// ApplySummary counts what an apply did
+type ApplySummary struct {
+	// Run identifies the actions of this apply in the journal
+	Run     string
+	Applied int
+	Skipped int
+	Bytes   int64
+}
+
+// ApplyRun takes the configured action on every duplicate that is not the keeper of its group and
+// updates the datastore to match. Groups of the collections that share a file are treated as
+// one, so every duplicate is measured against a keeper that stays in place; images of a group
+// that are not within the threshold of its keeper are left alone. Every action is recorded in
+// the journal before it is taken, and whether it was taken after, so UndoRun can reverse it. A
+// deleted or linked duplicate is restored from its keeper when they were byte-identical, and from
+// the stash otherwise.
+func ApplyRun(cfg ApplyConfig) (ApplySummary, error) {
+	sum := ApplySummary{Run: runID()}
+
+	if !validAction(cfg.Action) {
+		return sum, fmt.Errorf("unknown action: %s", cfg.Action)
+	}
+	if cfg.Action == ActionQuarantine && cfg.Quarantine == "" {
+		return sum, fmt.Errorf("%s needs a quarantine directory", cfg.Action)
+	}
+	if cfg.Action != ActionQuarantine && cfg.Stash == "" {
+		return sum, fmt.Errorf("%s needs a stash directory", cfg.Action)
+	}
+	if _, err := img.NewFingerPrinter(cfg.Algorithm, nil); err != nil {
+		return sum, err
+	}
+
+	ix, err := index.Open(cfg.Datastore, cfg.FingerPrintCol)
+	if err != nil {
+		return sum, err
+	}
+
+	var contents []match.Group
+	cols := []string{cfg.FingerPrintCol}
+	if cfg.ContentCol != "" {
+		contents, err = match.Groups(cfg.Datastore, cfg.ContentCol, 0, nil)
+		if err != nil {
+			return sum, err
+		}
+		cols = append(cols, cfg.ContentCol)
+	}
+	fingerPrints, err := match.Groups(cfg.Datastore, cfg.FingerPrintCol, cfg.Threshold, ix)
+	if err != nil {
+		return sum, err
+	}
+
+	verb := map[string]string{
+		ActionDelete:     "deleted",
+		ActionQuarantine: "quarantined",
+		ActionHardlink:   "hardlinked",
+		ActionSymlink:    "symlinked",
+	}[cfg.Action]
+	if cfg.DryRun {
+		verb = "would have " + verb
+	}
+
+	for _, cluster := range clusters(contents, fingerPrints) {
+		kept := keeper.Choose(cfg.Keep, cluster.images, cluster.meta)
+		keptFile, keptPage := img.SplitPage(kept)
+
+		keptInfo, err := os.Stat(keptFile)
+		if err != nil {
+			log.Errorf("skipping the duplicates of %s: %s", kept, err)
+			sum.Skipped += len(cluster.images) - 1
+			continue
+		}
+		var keptHash []byte
+
+		for _, name := range cluster.images {
+			if name == kept {
+				continue
+			}
+			// groups chain images that are each near the next, so the ends of a chain can be
+			// further apart than the threshold
+			if !cluster.near(name, kept, cfg.Threshold) {
+				log.Infof("skipping %s: not within the threshold of %s", name, kept)
+				sum.Skipped++
+				continue
+			}
+			// a page cannot be acted on without the rest of its file, and a link would stand
+			// for every page of the keeper
+			if _, page := img.SplitPage(name); page > 0 {
+				log.Errorf("skipping %s: a page of a multi-page TIFF", name)
+				sum.Skipped++
+				continue
+			}
+			if keptPage > 0 && (cfg.Action == ActionHardlink || cfg.Action == ActionSymlink) {
+				log.Errorf("skipping %s: cannot link to a page of a multi-page TIFF: %s", name, kept)
+				sum.Skipped++
+				continue
+			}
+
+			fi, err := os.Stat(name)
+			if err != nil {
+				log.Errorf("skipping %s: %s", name, err)
+				sum.Skipped++
+				continue
+			}
+			if os.SameFile(fi, keptInfo) {
+				log.Debugf("skipping %s: already the same file as %s", name, kept)
+				continue
+			}
+			if !current(cfg.Datastore, cols, name, fi) {
+				log.Errorf("skipping %s: changed since it was scanned", name)
+				sum.Skipped++
+				continue
+			}
+
+			if !cfg.DryRun {
+				hash, err := fs.ContentHash(name)
+				if err != nil {
+					log.Errorf("skipping %s: %s", name, err)
+					sum.Skipped++
+					continue
+				}
+				var stashed string
+				if cfg.Action != ActionQuarantine {
+					if keptHash == nil {
+						keptHash, _ = fs.ContentHash(keptFile)
+					}
+					if !bytes.Equal(hash, keptHash) {
+						stashed = quarantinePath(filepath.Join(cfg.Stash, sum.Run), name)
+						if err := stash(name, stashed); err != nil {
+							log.Errorf("skipping %s: %s", name, err)
+							sum.Skipped++
+							continue
+						}
+						log.Debugf("stashed %s at %s", name, stashed)
+					}
+				}
+
+				// the journal knows of the action before it is taken, so it can be undone even
+				// when apply does not get to complete the entry
+				e := datastore.JournalEntry{
+					Run:     sum.Run,
+					Time:    time.Now(),
+					Action:  cfg.Action,
+					Path:    name,
+					Keeper:  keptFile,
+					Hash:    hash,
+					Pending: true,
+				}
+				if cfg.Action == ActionQuarantine {
+					e.Dest = quarantinePath(cfg.Quarantine, name)
+				} else {
+					e.Dest = stashed
+				}
+				seq, err := cfg.Datastore.AppendJournal(e)
+				if err != nil {
+					if stashed != "" {
+						os.Remove(stashed)
+					}
+					return sum, err
+				}
+
+				if err := applyAction(cfg, name, kept); err != nil {
+					if stashed != "" {
+						os.Remove(stashed)
+					}
+					if err := cfg.Datastore.AbortJournal(seq); err != nil {
+						return sum, err
+					}
+					log.Errorf("skipping %s: %s", name, err)
+					sum.Skipped++
+					continue
+				}
+				if err := cfg.Datastore.CompleteJournal(seq); err != nil {
+					return sum, err
+				}
+				if err := applyRecord(cfg, cols, name, kept); err != nil {
+					return sum, err
+				}
+			}
+			log.Infof("%s %s (keeping %s)", verb, name, kept)
+			sum.Applied++
+			sum.Bytes += fi.Size()
+		}
+	}
+
+	log.Infof("%s %d duplicates (%d bytes); skipped %d", verb, sum.Applied, sum.Bytes, sum.Skipped)
+	if !cfg.DryRun && sum.Applied > 0 {
+		log.Infof("journal run: %s", sum.Run)
+	}
+	return sum, nil
+}
+
+// runID returns an identifier for the journal entries of a command, ordered by time
+func runID() string {
+	return time.Now().UTC().Format("20060102T150405.000000Z")
+}
+
+// applyAction takes the action on a duplicate
+func applyAction(cfg ApplyConfig, name, kept string) error {
+	switch cfg.Action {
+	case ActionDelete:
+		return os.Remove(name)
+	case ActionQuarantine:
+		return fs.Move(name, quarantinePath(cfg.Quarantine, name))
+	case ActionHardlink, ActionSymlink:
+		return fs.ReplaceWithLink(name, kept, cfg.Action == ActionSymlink)
+	}
+	return fmt.Errorf("unknown action: %s", cfg.Action)
+}
+
+// applyRecord records the result of an action on a duplicate in the collections
+func applyRecord(cfg ApplyConfig, cols []string, name, kept string) error {
+	if cfg.Action == ActionHardlink || cfg.Action == ActionSymlink {
+		return relink(cfg.Datastore, cols, name, kept)
+	}
+	return forget(cfg.Datastore, cols, name)
+}
+
+// stash copies a duplicate that is about to be removed to where undo can restore it from
+func stash(name, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return fs.Copy(name, dst)
+}
+
+// quarantinePath returns where a file goes in the quarantine tree
+func quarantinePath(dir, name string) string {
+	if d, err := filepath.Abs(dir); err == nil {
+		dir = d
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		abs = name
+	}
+	return filepath.Join(dir, strings.TrimPrefix(abs, filepath.VolumeName(abs)))
+}
+
+// current reports whether a file still matches what every collection that has it recorded
+func current(ds *datastore.Datastore, cols []string, name string, fi os.FileInfo) bool {
+	for _, col := range cols {
+		rec, err := ds.GetPath(col, name)
+		if err != nil {
+			return false
+		}
+		if rec != nil && !rec.Matches(fi.ModTime().UnixNano(), fi.Size(), fs.Inode(fi)) {
+			return false
+		}
+	}
+	return true
+}
+
+// forget removes a file from the collections
+func forget(ds *datastore.Datastore, cols []string, name string) error {
+	for _, col := range cols {
+		rec, err := ds.GetPath(col, name)
+		if err != nil {
+			return err
+		}
+		if rec == nil {
+			continue
+		}
+		if err := ds.Remove(col, rec.FingerPrint, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relink stores a file that was replaced with a link to kept under the fingerprint of kept
+func relink(ds *datastore.Datastore, cols []string, name, kept string) error {
+	if err := forget(ds, cols, name); err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	for _, col := range cols {
+		rec, err := ds.GetPath(col, kept)
+		if err != nil {
+			return err
+		}
+		if rec == nil {
+			continue
+		}
+		files, err := ds.Get(col, rec.FingerPrint)
+		if err != nil {
+			return err
+		}
+
+		meta := make(map[string][]byte)
+		for k, v := range files[kept] {
+			meta[k] = v
+		}
+		for k, v := range fileMeta(fi) {
+			meta[k] = v
+		}
+		if err := ds.Add(col, rec.FingerPrint, name, meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cluster is a set of images that are duplicates in at least one collection
+type cluster struct {
+	images []string
+	meta   map[string]map[string][]byte
+	// contents and fps are the content hash and the fingerprint stored for each image
+	contents map[string][]byte
+	fps      map[string][]byte
+}
+
+// clusters merges the groups of the content and fingerprint collections that share an image. The
+// metadata of the fingerprint collection, which knows the image sizes, wins.
+func clusters(contents, fingerPrints []match.Group) []cluster {
+	parent := make(map[string]string)
+	var find func(string) string
+	find = func(s string) string {
+		if parent[s] != s {
+			parent[s] = find(parent[s])
+		}
+		return parent[s]
+	}
+
+	meta := make(map[string]map[string][]byte)
+	hashes := make(map[string][]byte)
+	fps := make(map[string][]byte)
+	for j, groups := range [][]match.Group{contents, fingerPrints} {
+		for _, g := range groups {
+			for _, i := range g.Images {
+				if _, found := parent[i]; !found {
+					parent[i] = i
+				}
+				meta[i] = g.Meta[i]
+				if j == 0 {
+					hashes[i] = g.FingerPrint(i)
+				} else {
+					fps[i] = g.FingerPrint(i)
+				}
+				parent[find(i)] = find(g.Images[0])
+			}
+		}
+	}
+
+	// exact copies are left out of the fingerprint collection, so they take the fingerprint of a
+	// byte-identical image that is in it
+	byHash := make(map[string][]byte)
+	for i, fp := range fps {
+		if h := hashes[i]; h != nil {
+			byHash[string(h)] = fp
+		}
+	}
+	for i, h := range hashes {
+		if fps[i] == nil && byHash[string(h)] != nil {
+			fps[i] = byHash[string(h)]
+		}
+	}
+
+	members := make(map[string][]string)
+	for i := range parent {
+		root := find(i)
+		members[root] = append(members[root], i)
+	}
+
+	res := make([]cluster, 0, len(members))
+	for _, m := range members {
+		sort.Strings(m)
+		res = append(res, cluster{images: m, meta: meta, contents: hashes, fps: fps})
+	}
+	sort.Slice(res, func(a, b int) bool {
+		return res[a].images[0] < res[b].images[0]
+	})
+	return res
+}
+
+// near reports whether an image of the cluster duplicates kept: a byte-identical copy of it, or
+// within threshold bits of it
+func (c cluster) near(name, kept string, threshold int) bool {
+	if h := c.contents[name]; h != nil && bytes.Equal(h, c.contents[kept]) {
+		return true
+	}
+	a, b := c.fps[name], c.fps[kept]
+	return a != nil && b != nil && img.Distance(a, b) <= threshold
+}
+
+// validAction reports whether action is a known action
+func validAction(action string) bool {
+	for _, a := range Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
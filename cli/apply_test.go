@@ -0,0 +1,201 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/marklap/imgdupdetect/datastore"
+	"github.com/marklap/imgdupdetect/img"
+)
+
+// tstStore writes a file and stores it under fp with the metadata of a width x height image
+func tstStore(t *testing.T, ds *datastore.Datastore, col string, fp []byte, path, content string, width, height uint64) {
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := fileMeta(fi)
+	meta["width"] = datastore.Uint64Bytes(width)
+	meta["height"] = datastore.Uint64Bytes(height)
+	if err := ds.Add(col, fp, path, meta); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tstApply applies an action to the duplicates of a test datastore
+func tstApply(t *testing.T, ds *datastore.Datastore, dir, action string, threshold int) ApplySummary {
+	sum, err := ApplyRun(ApplyConfig{
+		Datastore:      ds,
+		FingerPrintCol: tstFingerPrintCol,
+		Algorithm:      img.AlgoDHash,
+		Threshold:      threshold,
+		Action:         action,
+		Quarantine:     filepath.Join(dir, "quarantine"),
+		Stash:          filepath.Join(dir, "stash"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sum
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func TestApplyChain(t *testing.T) {
+	dir, ds := tstDir(t)
+	defer os.RemoveAll(dir)
+	defer ds.Close()
+
+	// b is within 3 bits of a and of c, but a and c are 6 bits apart
+	a, b, c := filepath.Join(dir, "a.jpg"), filepath.Join(dir, "b.jpg"), filepath.Join(dir, "c.jpg")
+	tstStore(t, ds, tstFingerPrintCol, []byte{0x00, 0, 0, 0, 0, 0, 0, 0}, a, "a", 200, 100)
+	tstStore(t, ds, tstFingerPrintCol, []byte{0x07, 0, 0, 0, 0, 0, 0, 0}, b, "b", 100, 100)
+	tstStore(t, ds, tstFingerPrintCol, []byte{0x3f, 0, 0, 0, 0, 0, 0, 0}, c, "c", 100, 100)
+
+	sum := tstApply(t, ds, dir, ActionDelete, 4)
+	if sum.Applied != 1 || sum.Skipped != 1 {
+		t.Errorf("summary mismatch - want: 1 applied, 1 skipped, got: %+v", sum)
+	}
+	if !exists(a) || exists(b) || !exists(c) {
+		t.Errorf("files left mismatch - want: a, c, got: a %t, b %t, c %t", exists(a), exists(b), exists(c))
+	}
+}
+
+func TestApplyActions(t *testing.T) {
+	for _, action := range Actions {
+		dir, ds := tstDir(t)
+
+		kept, dup := filepath.Join(dir, "kept.jpg"), filepath.Join(dir, "dup.jpg")
+		fp := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+		tstStore(t, ds, tstFingerPrintCol, fp, kept, "kept", 200, 100)
+		tstStore(t, ds, tstFingerPrintCol, fp, dup, "dup", 100, 100)
+
+		sum := tstApply(t, ds, dir, action, 0)
+		if sum.Applied != 1 || sum.Skipped != 0 || sum.Bytes != 3 {
+			t.Errorf("%s: summary mismatch - want: 1 applied of 3 bytes, got: %+v", action, sum)
+		}
+		if got, err := os.ReadFile(kept); err != nil || string(got) != "kept" {
+			t.Errorf("%s: keeper changed - got: %s (%v)", action, got, err)
+		}
+
+		switch action {
+		case ActionDelete:
+			if exists(dup) {
+				t.Errorf("%s: duplicate still exists", action)
+			}
+		case ActionQuarantine:
+			if got, err := os.ReadFile(quarantinePath(filepath.Join(dir, "quarantine"), dup)); err != nil || string(got) != "dup" {
+				t.Errorf("%s: quarantined content mismatch - got: %s (%v)", action, got, err)
+			}
+		case ActionHardlink, ActionSymlink:
+			fi, err := os.Lstat(dup)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if isLink := fi.Mode()&os.ModeSymlink != 0; isLink != (action == ActionSymlink) {
+				t.Errorf("%s: link type mismatch - got symbolic: %t", action, isLink)
+			}
+			if got, err := os.ReadFile(dup); err != nil || string(got) != "kept" {
+				t.Errorf("%s: linked content mismatch - got: %s (%v)", action, got, err)
+			}
+		}
+
+		// the duplicate was not byte-identical to its keeper, so it can be restored from the stash
+		if action != ActionQuarantine {
+			if got, err := os.ReadFile(quarantinePath(filepath.Join(dir, "stash", sum.Run), dup)); err != nil || string(got) != "dup" {
+				t.Errorf("%s: stashed content mismatch - got: %s (%v)", action, got, err)
+			}
+		}
+
+		journal, err := ds.Journal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(journal) != 1 || journal[0].Action != action || journal[0].Path != dup || journal[0].Keeper != kept {
+			t.Errorf("%s: journal mismatch - got: %+v", action, journal)
+		}
+
+		ds.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestApplyAborted(t *testing.T) {
+	dir, ds := tstDir(t)
+	defer os.RemoveAll(dir)
+	defer ds.Close()
+
+	kept, dup := filepath.Join(dir, "kept.jpg"), filepath.Join(dir, "dup.jpg")
+	fp := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	tstStore(t, ds, tstFingerPrintCol, fp, kept, "kept", 200, 100)
+	tstStore(t, ds, tstFingerPrintCol, fp, dup, "dup", 100, 100)
+
+	// the quarantine directory cannot be created, so the move fails after it was journaled
+	if err := os.WriteFile(filepath.Join(dir, "quarantine"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if sum := tstApply(t, ds, dir, ActionQuarantine, 0); sum.Applied != 0 || sum.Skipped != 1 {
+		t.Errorf("summary mismatch - want: 1 skipped, got: %+v", sum)
+	}
+
+	records, err := ds.JournalRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || !records[0].Pending || records[0].Path != dup ||
+		records[1].Action != datastore.JournalAbort || records[1].Settles != records[0].Seq {
+		t.Errorf("journal records mismatch - want: pending and abort, got: %+v", records)
+	}
+}
+
+func TestApplyFailed(t *testing.T) {
+	for _, tst := range []struct {
+		action  string
+		blocked string
+		aborted int
+	}{
+		// the copy kept to undo the delete cannot be made, so nothing is journaled
+		{ActionDelete, "stash", 0},
+		// the move fails after it was journaled
+		{ActionQuarantine, "quarantine", 1},
+	} {
+		dir, ds := tstDir(t)
+
+		kept, dup := filepath.Join(dir, "kept.jpg"), filepath.Join(dir, "dup.jpg")
+		fp := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+		tstStore(t, ds, tstFingerPrintCol, fp, kept, "kept", 200, 100)
+		tstStore(t, ds, tstFingerPrintCol, fp, dup, "dup", 100, 100)
+
+		// a file in place of the directory makes the action fail even for root
+		if err := os.WriteFile(filepath.Join(dir, tst.blocked), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if sum := tstApply(t, ds, dir, tst.action, 0); sum.Applied != 0 || sum.Skipped != 1 {
+			t.Errorf("%s: summary mismatch - want: 1 skipped, got: %+v", tst.action, sum)
+		}
+		if got, err := os.ReadFile(dup); err != nil || string(got) != "dup" {
+			t.Errorf("%s: duplicate changed - got: %s (%v)", tst.action, got, err)
+		}
+		if rec, err := ds.GetPath(tstFingerPrintCol, dup); err != nil || rec == nil {
+			t.Errorf("%s: duplicate forgotten - got: %v (%v)", tst.action, rec, err)
+		}
+
+		journal, err := ds.Journal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(journal) != tst.aborted || (tst.aborted > 0 && (!journal[0].Aborted || journal[0].Pending)) {
+			t.Errorf("%s: journal mismatch - want: %d aborted, got: %+v", tst.action, tst.aborted, journal)
+		}
+
+		ds.Close()
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,111 @@
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/marklap/imgdupdetect/datastore"
+	"github.com/marklap/imgdupdetect/index"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errNotConfirmed is returned when a clear was not confirmed
+var errNotConfirmed = errors.New("clear not confirmed; pass -yes to skip the question")
+
+// ClearConfig is the clear CLI config
+type ClearConfig struct {
+
+	// Datastore is the datastore
+	Datastore *datastore.Datastore
+	// Cols are the names of the collections to clear
+	Cols []string
+	// Dirs limits the clear to the files within these directories; empty clears whole collections
+	Dirs []string
+	// Yes skips the confirmation question
+	Yes bool
+	// In is where the answer to the confirmation question is read from
+	In io.Reader
+	// Out is where the confirmation question is written to
+	Out io.Writer
+}
+
+// ClearSummary counts what a clear removed
+type ClearSummary struct {
+	FingerPrints int
+	Paths        int
+}
+
+// ClearRun removes whole collections, or only the files within the given directories, after
+// asking for confirmation
+func ClearRun(cfg ClearConfig) (ClearSummary, error) {
+	var sum ClearSummary
+
+	// files are stored under the path they were found with, which may be relative
+	var dirs []string
+	for _, d := range cfg.Dirs {
+		dirs = append(dirs, filepath.Clean(d))
+		if abs, err := filepath.Abs(d); err == nil && abs != filepath.Clean(d) {
+			dirs = append(dirs, abs)
+		}
+	}
+
+	if !cfg.Yes {
+		what := "everything in " + strings.Join(cfg.Cols, ", ")
+		if len(dirs) > 0 {
+			what = "the files within " + strings.Join(cfg.Dirs, ", ") + " from " + strings.Join(cfg.Cols, ", ")
+		}
+		ok, err := confirm(cfg.In, cfg.Out, "clear "+what+"?")
+		if err != nil {
+			return sum, err
+		}
+		if !ok {
+			return sum, errNotConfirmed
+		}
+	}
+
+	for _, col := range cfg.Cols {
+		var fps, paths int
+		var err error
+		if len(dirs) == 0 {
+			fps, paths, err = cfg.Datastore.Drop(col)
+			if err == nil {
+				err = index.Drop(cfg.Datastore, col)
+			}
+		} else {
+			// removing fingerprints moves the collection to its next generation, so an index that
+			// was not open to follow the removal sees it missed a change and is rebuilt on open
+			fps, paths, err = cfg.Datastore.RemoveUnder(col, dirs)
+		}
+		if err != nil {
+			return sum, err
+		}
+		log.Infof("cleared %s: %d fingerprints, %d paths", col, fps, paths)
+		sum.FingerPrints += fps
+		sum.Paths += paths
+	}
+
+	log.Infof("cleared %d fingerprints and %d paths", sum.FingerPrints, sum.Paths)
+	return sum, nil
+}
+
+// confirm asks a yes/no question and reports whether it was answered yes
+func confirm(in io.Reader, out io.Writer, question string) (bool, error) {
+	if in == nil || out == nil {
+		return false, nil
+	}
+	fmt.Fprintf(out, "%s [y/N] ", question)
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
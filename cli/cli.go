@@ -1,33 +1,20 @@
 package cli
 
 import (
-	"crypto/rand"
-	"fmt"
 	"os"
-	"path/filepath"
-	"strings"
+	"sort"
 
 	"github.com/marklap/imgdupdetect/datastore"
 	"github.com/marklap/imgdupdetect/fs"
 	"github.com/marklap/imgdupdetect/img"
+	"github.com/marklap/imgdupdetect/index"
+	"github.com/marklap/imgdupdetect/keeper"
+	"github.com/marklap/imgdupdetect/match"
 	"github.com/marklap/imgdupdetect/stats"
 
-	"github.com/rwcarlsen/goexif/exif"
-	"github.com/rwcarlsen/goexif/mknote"
-
 	log "github.com/sirupsen/logrus"
 )
 
-func uuid() string {
-	buf := make([]byte, 6)
-	_, err := rand.Read(buf)
-	if err != nil {
-		return ""
-	}
-	id := fmt.Sprintf("%012x", buf)
-	return id
-}
-
 // DupeDetectConfig is the duplicate detector CLI config
 type DupeDetectConfig struct {
 
@@ -37,144 +24,356 @@ type DupeDetectConfig struct {
 	Datastore *datastore.Datastore
 	// FingerPrintCol is the name of the collection to use for fingerprints
 	FingerPrintCol string
+	// Algorithm is the name of the fingerprint algorithm (see img.Algorithms)
+	Algorithm string
+	// Threshold is the number of differing fingerprint bits still considered a duplicate
+	Threshold int
+	// ContentCol is the name of the collection to use for file content hashes; exact copies are
+	// found there without decoding any pixels. Empty turns the content tier off.
+	ContentCol string
+	// Workers is the number of images decoded and fingerprinted at once
+	Workers int
+	// MemoryBudget is the number of bytes of decoded pixels held at once; 0 means no limit
+	MemoryBudget int64
+	// Keep selects the file of each group worth keeping; empty uses keeper.Default
+	Keep keeper.Chain
+	// Sniff also finds the images their extension does not name, by their content
+	Sniff bool
 }
 
-// ReloConfig is the relocation CLI config
-type ReloConfig struct {
-
-	// From is the directory of the source images
-	From string
-	// To is the target directory
-	To string
-}
-
-// ReloRun runs the relocation function
-func ReloRun(cfg ReloConfig) error {
-	log.Debug("relo from: ", cfg.From)
-	log.Debug("relo to: ", cfg.To)
+// DupeDetectRun fingerprints the images in the configured directories and reports the duplicates
+// in the datastore. The returned stats count the duplicates found.
+func DupeDetectRun(cfg DupeDetectConfig) (*stats.ScanStats, error) {
+	scanStats := stats.NewScanStats()
 
-	p, err := fs.NewPath(cfg.From, []fs.Matcher{img.TIFFMatch, img.JPGMatch})
-	if err != nil {
-		log.Error(err)
-		os.Exit(1)
+	if _, err := img.NewFingerPrinter(cfg.Algorithm, nil); err != nil {
+		return nil, err
 	}
 
-	imgPaths, err := p.Find()
+	ix, err := index.Open(cfg.Datastore, cfg.FingerPrintCol)
 	if err != nil {
-		log.Error(err)
-		os.Exit(1)
+		return nil, err
 	}
 
-	exif.RegisterParsers(mknote.All...)
-
-	for _, path := range imgPaths {
-		var err error
-		// var i *img.Image
-		// i, err = img.NewImage(path)
-		// if err != nil {
-		// 	log.Error(err)
-		// }
-
-		fd, err := os.Open(path)
-		defer fd.Close()
-
+	log.Info("looking for duplicates...")
+	matchers := imageMatchers(cfg.Sniff)
+	var imgPaths []string
+	for _, d := range cfg.Dirs {
+		log.Infof(" - %s", d)
+		p, err := fs.NewPath(d, matchers)
 		if err != nil {
 			log.Error(err)
-			return err
+			continue
 		}
 
-		ximg, err := exif.Decode(fd)
+		found, err := p.Find()
 		if err != nil {
 			log.Error(err)
-			return err
+			continue
+		}
+		reportFormats(p.Formats)
+		imgPaths = append(imgPaths, found...)
+	}
+	scanStats.AddImagesFound(len(imgPaths))
+
+	cols := []string{cfg.FingerPrintCol}
+	if cfg.ContentCol != "" {
+		cols = append(cols, cfg.ContentCol)
+	}
+	if err := forgetChanged(cfg.Datastore, cols, imgPaths); err != nil {
+		return nil, err
+	}
+
+	var copies map[string]bool
+	if cfg.ContentCol != "" {
+		err = hashContents(cfg, imgPaths, scanStats)
+		if err != nil {
+			return nil, err
 		}
+		copies, err = exactCopies(cfg, imgPaths, scanStats)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	known, err := cfg.Datastore.GetPaths(cfg.FingerPrintCol)
+	if err != nil {
+		return nil, err
+	}
 
-		dt, _ := ximg.DateTime()
-		if dt.IsZero() {
-			log.Error("not a date")
+	var remaining []string
+	for _, imgPath := range imgPaths {
+		if copies[imgPath] {
+			log.Debugf("skipping exact copy: %s", imgPath)
 			continue
 		}
+		// every page of a multi-page TIFF is fingerprinted on its own
+		for _, name := range img.Pages(imgPath) {
+			if unchanged(known, name) {
+				log.Debugf("skipping unchanged file: %s", name)
+				scanStats.AddSkipped(1)
+				continue
+			}
+			remaining = append(remaining, name)
+		}
+	}
 
-		base := filepath.Base(path)
-		parts := strings.SplitN(base, ".", 2)
+	err = fingerPrintAll(cfg, remaining, scanStats)
+	if err != nil {
+		return nil, err
+	}
 
-		fmt.Println(
-			path,
-			filepath.Join(
-				cfg.To,
-				dt.Format("2006-01-02"),
-				strings.ToLower(strings.Join([]string{parts[0], uuid(), parts[1]}, ".")),
-			),
-		)
+	err = reportDuplicates(cfg, ix, scanStats)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	scanStats.Complete()
+	log.Info(scanStats)
+
+	return scanStats, nil
 }
 
-// DupeDetectRun runs the duplicate detect function
-func DupeDetectRun(cfg DupeDetectConfig, cmd string) error {
-	scanStats := stats.NewScanStats()
+// imageMatchers returns the matchers that find the images the fingerprinters decode by their
+// extension, followed when sniff is set by the content matcher, so only the files the extensions
+// miss are read
+func imageMatchers(sniff bool) []fs.Matcher {
+	matchers := []fs.Matcher{img.GIFMatch, img.JPGMatch, img.PNGMatch, img.TIFFMatch, img.RAWMatch, img.WebPMatch, img.BMPMatch}
+	if sniff {
+		matchers = append(matchers, img.ContentMatch)
+	}
+	return matchers
+}
 
-	log.Info("looking for duplicates...")
-	matchers := []fs.Matcher{img.GIFMatch, img.JPGMatch, img.PNGMatch}
-	for _, d := range cfg.Dirs {
-		log.Infof(" - %s", d)
-		p, err := fs.NewPath(d, matchers)
+// reportFormats logs how many images of each format content matchers found, and the images whose
+// extension names another format than their content
+func reportFormats(formats map[string]string) {
+	if len(formats) == 0 {
+		return
+	}
+
+	counts := make(map[string]int)
+	var misnamed []string
+	for path, format := range formats {
+		counts[format]++
+		if img.ExtFormat(path) != format {
+			misnamed = append(misnamed, path)
+		}
+	}
+
+	names := make([]string, 0, len(counts))
+	for format := range counts {
+		names = append(names, format)
+	}
+	sort.Strings(names)
+	for _, format := range names {
+		log.Infof("   %s: %d", format, counts[format])
+	}
+
+	sort.Strings(misnamed)
+	for _, path := range misnamed {
+		log.Infof("   ~ %s is %s", path, formats[path])
+	}
+}
+
+// reportDuplicates logs the groups of duplicates of the fingerprint collection, and the crops
+// when the images were fingerprinted with keypoints
+func reportDuplicates(cfg DupeDetectConfig, ix *index.Index, scanStats *stats.ScanStats) error {
+	groups, err := match.Groups(cfg.Datastore, cfg.FingerPrintCol, cfg.Threshold, ix)
+	if err != nil {
+		return err
+	}
+
+	for _, g := range groups {
+		scanStats.AddDuplicatesFound(len(g.Images) - 1) // we don't count the original
+		log.Info("found duplicates:")
+		for _, i := range g.Images {
+			log.Infof("  - %s", i)
+		}
+		log.Infof("  ~ keep %s", keeper.Choose(cfg.Keep, g.Images, g.Meta))
+		for j, a := range g.Images {
+			for _, b := range g.Images[j+1:] {
+				if img.SameShot(a, b) {
+					log.Infof("  ~ same shot: %s and %s", a, b)
+				}
+			}
+		}
+		if cfg.Threshold > 0 {
+			for _, p := range g.Pairs {
+				log.Infof("  ~ distance %d: %s <-> %s", p.Distance, p.A, p.B)
+			}
+		}
+		for _, p := range g.Pairs {
+			if p.Transform != img.Identity {
+				log.Infof("  ~ %s is %s %s", p.B, p.A, p.Transform)
+			}
+		}
+	}
+
+	if cfg.Algorithm != img.AlgoKeyPoints {
+		return nil
+	}
+
+	grouped := make(map[string]int)
+	for j, g := range groups {
+		for _, i := range g.Images {
+			grouped[i] = j + 1
+		}
+	}
+
+	crops, err := match.Containments(cfg.Datastore, cfg.FingerPrintCol)
+	if err != nil {
+		return err
+	}
+	for _, c := range crops {
+		if n := grouped[c.Inner]; n > 0 && n == grouped[c.Outer] {
+			continue // already reported as duplicates
+		}
+		scanStats.AddDuplicatesFound(1)
+		log.Infof("found crop: %s is contained in %s (overlap %.0f%%)", c.Inner, c.Outer, c.Overlap*100)
+	}
+	return nil
+}
+
+// hashContents stores the content hash of every file that has the same size as another file.
+// Files with a unique size in this scan are not hashed; copies of them from earlier scans are left
+// to the pixel tier. Files that changed since they were hashed must have been forgotten by
+// forgetChanged, so they are hashed again when they still share their size and drop out of the
+// content tier when they do not.
+func hashContents(cfg DupeDetectConfig, paths []string, scanStats *stats.ScanStats) error {
+	bySize := make(map[int64][]string)
+	for _, path := range paths {
+		fi, err := os.Stat(path)
 		if err != nil {
 			log.Error(err)
 			continue
 		}
+		bySize[fi.Size()] = append(bySize[fi.Size()], path)
+	}
 
-		imgPaths, err := p.Find()
-		if err != nil {
-			log.Error(err)
+	known, err := cfg.Datastore.GetPaths(cfg.ContentCol)
+	if err != nil {
+		return err
+	}
+
+	for _, same := range bySize {
+		if len(same) < 2 {
 			continue
 		}
 
-		for _, imgPath := range imgPaths {
-			i, err := img.NewImage(imgPath)
-			if err != nil {
-				log.Error(err)
+		for _, path := range same {
+			if unchanged(known, path) {
 				continue
 			}
-			scanStats.ImagesFound++
 
-			meta := map[string][]byte{
-				"size":   i.SizeByteSlice(),
-				"height": i.HeightByteSlice(),
-				"width":  i.WidthByteSlice(),
+			fi, err := os.Stat(path)
+			if err != nil {
+				log.Error(err)
+				continue
 			}
 
-			fp, err := i.FingerPrint()
+			sum, err := fs.ContentHash(path)
 			if err != nil {
 				log.Error(err)
 				continue
 			}
-			scanStats.FingerPrintCount++
+			scanStats.AddContentHashCount(1)
 
-			err = cfg.Datastore.Add(cfg.FingerPrintCol, fp, imgPath, meta)
+			err = cfg.Datastore.Add(cfg.ContentCol, sum, path, fileMeta(fi))
 			if err != nil {
 				log.Error(err)
 				continue
 			}
 		}
 	}
+	return nil
+}
+
+// exactCopies reports the groups of byte-identical files of the content collection. It returns
+// every file of each group that is part of this scan but the first one that is, so only one copy
+// goes on to the pixel fingerprinters. A group with a single file of this scan has no copies to
+// skip; its other files are fingerprinted by the scans that find them.
+func exactCopies(cfg DupeDetectConfig, paths []string, scanStats *stats.ScanStats) (map[string]bool, error) {
+	groups, err := match.Groups(cfg.Datastore, cfg.ContentCol, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	scanned := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		scanned[path] = true
+	}
 
-	fps := cfg.Datastore.GetFingerPrints(cfg.FingerPrintCol)
-	for _, fp := range fps {
-		ims := cfg.Datastore.GetImages(cfg.FingerPrintCol, fp)
-		imsLen := len(ims)
-		if imsLen > 1 {
-			scanStats.DuplicatesFound += imsLen - 1 // we don't count the original
-			log.Info("found duplicates:")
-			for _, i := range ims {
-				log.Infof("  - %s", i)
+	copies := make(map[string]bool)
+	for _, g := range groups {
+		scanStats.AddDuplicatesFound(len(g.Images) - 1) // we don't count the original
+		log.Info("found exact copies:")
+		var original string
+		for _, i := range g.Images {
+			log.Infof("  - %s", i)
+			if !scanned[i] {
+				continue
+			}
+			if original == "" {
+				if _, err := os.Stat(i); err == nil {
+					original = i
+				}
+				continue
 			}
+			copies[i] = true
 		}
+		log.Infof("  ~ keep %s", keeper.Choose(cfg.Keep, g.Images, g.Meta))
 	}
+	return copies, nil
+}
 
-	scanStats.Complete()
-	log.Info(scanStats)
+// fileMeta returns the metadata the datastore needs to tell whether a file changed
+func fileMeta(fi os.FileInfo) map[string][]byte {
+	return map[string][]byte{
+		datastore.MetaSize:    datastore.Uint64Bytes(uint64(fi.Size())),
+		datastore.MetaModTime: datastore.Uint64Bytes(uint64(fi.ModTime().UnixNano())),
+		datastore.MetaInode:   datastore.Uint64Bytes(fs.Inode(fi)),
+	}
+}
+
+// forgetChanged removes the files of a scan that changed since they were stored from every
+// collection that has them, pages of multi-page TIFFs included. A changed file is only stored
+// again by the tiers it reaches this time, so a record left behind would still match it as what
+// it was before.
+func forgetChanged(ds *datastore.Datastore, cols []string, paths []string) error {
+	scanned := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		scanned[path] = true
+	}
 
+	for _, col := range cols {
+		known, err := ds.GetPaths(col)
+		if err != nil {
+			return err
+		}
+		for name, rec := range known {
+			if file, _ := img.SplitPage(name); !scanned[file] || unchanged(known, name) {
+				continue
+			}
+			log.Debugf("forgetting changed file: %s", name)
+			if err := ds.Remove(col, rec.FingerPrint, name); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
+
+// unchanged reports whether a file still matches the record stored for it
+func unchanged(known map[string]datastore.PathRecord, path string) bool {
+	rec, found := known[path]
+	if !found {
+		return false
+	}
+	file, _ := img.SplitPage(path)
+	fi, err := os.Stat(file)
+	if err != nil {
+		return false
+	}
+	return rec.Matches(fi.ModTime().UnixNano(), fi.Size(), fs.Inode(fi))
+}
@@ -0,0 +1,166 @@
+package cli
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/marklap/imgdupdetect/datastore"
+	"github.com/marklap/imgdupdetect/fs"
+	"github.com/marklap/imgdupdetect/img"
+)
+
+const (
+	tstFingerPrintCol = "fingerprints"
+	tstContentCol     = "contents"
+)
+
+// tstDir creates a directory with a datastore in it for a test
+func tstDir(t *testing.T) (string, *datastore.Datastore) {
+	dir, err := os.MkdirTemp("", "imgdd-cli-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := datastore.Open(datastore.Config{Path: filepath.Join(dir, "test.ds")})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dir, ds
+}
+
+// writePNG writes a w x h gray image whose pixels are given by fn
+func writePNG(t *testing.T, path string, w, h int, fn func(x, y int) uint8) {
+	m := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			m.SetGray(x, y, color.Gray{fn(x, y)})
+		}
+	}
+	fd, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	if err := png.Encode(fd, m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// hGradient and vGradient are images that share no pixel fingerprint
+func hGradient(x, y int) uint8 { return uint8(x * 8) }
+func vGradient(x, y int) uint8 { return uint8(y * 8) }
+
+// scan runs a scan of dir with both tiers
+func scan(t *testing.T, ds *datastore.Datastore, dir string) int64 {
+	st, err := DupeDetectRun(DupeDetectConfig{
+		Dirs:           []string{dir},
+		Datastore:      ds,
+		FingerPrintCol: tstFingerPrintCol,
+		Algorithm:      img.AlgoSHA256,
+		ContentCol:     tstContentCol,
+		Workers:        1,
+		Sniff:          true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st.DuplicatesFound
+}
+
+func TestRescanChanged(t *testing.T) {
+	dir, ds := tstDir(t)
+	defer os.RemoveAll(dir)
+	defer ds.Close()
+
+	a, b := filepath.Join(dir, "a.png"), filepath.Join(dir, "b.png")
+	writePNG(t, a, 32, 32, hGradient)
+	writePNG(t, b, 32, 32, hGradient)
+	if n := scan(t, ds, dir); n != 1 {
+		t.Fatalf("duplicates of identical files - want: 1, got: %d", n)
+	}
+
+	// b no longer shares its size with any file, so it is not hashed again
+	writePNG(t, b, 48, 40, vGradient)
+	if n := scan(t, ds, dir); n != 0 {
+		t.Errorf("duplicates after a file changed - want: 0, got: %d", n)
+	}
+	if rec, err := ds.GetPath(tstContentCol, b); err != nil || rec != nil {
+		t.Errorf("content record of a changed file - want: none, got: %v (%v)", rec, err)
+	}
+	ra, _ := ds.GetPath(tstFingerPrintCol, a)
+	rb, _ := ds.GetPath(tstFingerPrintCol, b)
+	if ra == nil || rb == nil || string(ra.FingerPrint) == string(rb.FingerPrint) {
+		t.Errorf("changed file not fingerprinted again - got: %v, %v", ra, rb)
+	}
+}
+
+func TestExactCopiesOriginalGone(t *testing.T) {
+	dir, ds := tstDir(t)
+	defer os.RemoveAll(dir)
+	defer ds.Close()
+
+	a, b := filepath.Join(dir, "a.png"), filepath.Join(dir, "b.png")
+	writePNG(t, a, 32, 32, hGradient)
+	writePNG(t, b, 32, 32, hGradient)
+	scan(t, ds, dir)
+	if rec, _ := ds.GetPath(tstFingerPrintCol, b); rec != nil {
+		t.Fatalf("exact copy fingerprinted - want: none, got: %v", rec)
+	}
+
+	// the copy that was fingerprinted is gone, so the other one must be fingerprinted now
+	if err := os.Remove(a); err != nil {
+		t.Fatal(err)
+	}
+	scan(t, ds, dir)
+	if rec, _ := ds.GetPath(tstFingerPrintCol, b); rec == nil {
+		t.Errorf("copy of a deleted file not fingerprinted")
+	}
+}
+
+func TestImageMatchers(t *testing.T) {
+	dir, err := os.MkdirTemp("", "imgdd-cli-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	named, bare, notes := filepath.Join(dir, "a.png"), filepath.Join(dir, "scan"), filepath.Join(dir, "notes.txt")
+	writePNG(t, named, 32, 32, hGradient)
+	writePNG(t, bare, 32, 32, vGradient)
+	if err := os.WriteFile(notes, []byte("BMW is a car maker"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tst := range []struct {
+		sniff   bool
+		want    []string
+		sniffed int
+	}{
+		{false, []string{named}, 0},
+		// the extension finds a.png, so only the other files are read
+		{true, []string{named, bare}, 1},
+	} {
+		p, err := fs.NewPath(dir, imageMatchers(tst.sniff))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := p.Find()
+		p.Root.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tst.want) {
+			t.Errorf("sniff %t: found mismatch - want: %s, got: %s", tst.sniff, tst.want, got)
+		}
+		if len(p.Formats) != tst.sniffed || (tst.sniffed > 0 && p.Formats[bare] != "png") {
+			t.Errorf("sniff %t: sniffed formats mismatch - want: %s as png, got: %v", tst.sniff, bare, p.Formats)
+		}
+	}
+}
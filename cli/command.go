@@ -0,0 +1,598 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/marklap/imgdupdetect/datastore"
+	"github.com/marklap/imgdupdetect/img"
+	"github.com/marklap/imgdupdetect/keeper"
+	"github.com/marklap/imgdupdetect/layout"
+	"github.com/marklap/imgdupdetect/report"
+	"github.com/marklap/imgdupdetect/ui"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Exit codes returned by Main
+const (
+	// ExitOK means the command succeeded and found no duplicates
+	ExitOK = 0
+	// ExitDuplicates means the command succeeded and found duplicates
+	ExitDuplicates = 1
+	// ExitError means the command failed
+	ExitError = 2
+)
+
+const (
+	fingerPrintCollection = "fingerprint"
+	contentCollection     = "content"
+)
+
+// command is a subcommand of the CLI
+type command struct {
+	name string
+	// args describes the positional arguments
+	args string
+	help string
+	// setup registers the flags of the command and returns the function that runs it with the
+	// positional arguments; the function reports whether duplicates were found
+	setup func(fset *flag.FlagSet) func(args []string) (bool, error)
+}
+
+// commands are the subcommands in the order they are listed in the usage
+var commands = []command{
+	{"scan", "dir...", "fingerprint the images in the directories and report the duplicates", scanCommand},
+	{"report", "", "report the duplicates already in the datastore without scanning", reportCommand},
+	{"apply", "", "delete, quarantine or link the duplicates that are not kept", applyCommand},
+	{"undo", "[entry...]", "reverse the actions of an apply run, or selected entries of it", undoCommand},
+	{"query", "image...", "look up the stored images that are duplicates of the given images", queryCommand},
+	{"prune", "", "remove the stored files that were deleted or changed since they were scanned", pruneCommand},
+	{"clear", "[dir...]", "remove everything, or the files within the directories, from the datastore", clearCommand},
+	{"relocate", "", "copy or move images into folders laid out by a template", relocateCommand},
+	{"serve", "[dir...]", "start the web user interface", serveCommand},
+}
+
+// usageError is an error in the arguments of a command
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+// Main runs the subcommand named by the first argument and returns the exit code
+func Main(args []string) int {
+	if len(args) == 0 {
+		usage(os.Stderr)
+		return ExitError
+	}
+
+	name := args[0]
+	switch name {
+	case "help", "-h", "-help", "--help":
+		if len(args) > 1 {
+			if c := lookup(args[1]); c != nil {
+				fset := newFlagSet(c, os.Stdout)
+				c.setup(fset)
+				fset.Usage()
+				return ExitOK
+			}
+		}
+		usage(os.Stdout)
+		return ExitOK
+	}
+
+	c := lookup(name)
+	if c == nil {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n", name)
+		usage(os.Stderr)
+		return ExitError
+	}
+
+	fset := newFlagSet(c, os.Stderr)
+	debug := fset.Bool("debug", false, "turn debug logging on")
+	run := c.setup(fset)
+	if err := fset.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return ExitOK
+		}
+		return ExitError
+	}
+
+	if *debug {
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(log.InfoLevel)
+	}
+
+	found, err := run(fset.Args())
+	if err != nil {
+		log.Error(err)
+		if _, ok := err.(usageError); ok {
+			fset.Usage()
+		}
+		return ExitError
+	}
+	if found {
+		return ExitDuplicates
+	}
+	return ExitOK
+}
+
+// lookup returns the command with a name, or nil
+func lookup(name string) *command {
+	for j := range commands {
+		if commands[j].name == name {
+			return &commands[j]
+		}
+	}
+	return nil
+}
+
+// newFlagSet creates the flag set of a command
+func newFlagSet(c *command, out io.Writer) *flag.FlagSet {
+	fset := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	fset.SetOutput(out)
+	fset.Usage = func() {
+		fmt.Fprintf(out, "usage: imgdd %s [flags] %s\n\n%s\n\nflags:\n", c.name, c.args, c.help)
+		fset.PrintDefaults()
+	}
+	return fset
+}
+
+// usage writes the list of commands and exit codes
+func usage(out io.Writer) {
+	fmt.Fprintf(out, "usage: imgdd <command> [flags] [args]\n\ncommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-10s %s\n", c.name, c.help)
+	}
+	fmt.Fprintf(out, "\nrun 'imgdd help <command>' for the flags of a command.\n")
+	fmt.Fprintf(out, "\nexit codes: %d no duplicates, %d duplicates found, %d error\n", ExitOK, ExitDuplicates, ExitError)
+}
+
+// here returns the absolute path of a file in the working directory
+func here(name string) string {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return name
+	}
+	return abs
+}
+
+// storeFlags are the flags of the commands that work on the datastore
+type storeFlags struct {
+	path  *string
+	algo  *string
+	exact *bool
+}
+
+// addStoreFlags registers the datastore flags
+func addStoreFlags(fset *flag.FlagSet) *storeFlags {
+	return &storeFlags{
+		path:  fset.String("datastore", here("imgdd.ds"), "path where the datastore should be saved"),
+		algo:  fset.String("algo", img.AlgoSHA256, "fingerprint algorithm: "+strings.Join(img.Algorithms, ", ")),
+		exact: fset.Bool("exact", true, "find byte-identical copies by content hash before decoding any pixels"),
+	}
+}
+
+// open validates the flags and opens the datastore
+func (f *storeFlags) open() (*datastore.Datastore, error) {
+	if !validAlgo(*f.algo) {
+		return nil, usageError("unknown fingerprint algorithm: " + *f.algo)
+	}
+	return datastore.Open(datastore.Config{Path: *f.path})
+}
+
+// fingerPrintCol returns the collection of the algorithm; each algorithm gets its own collection
+// and sha256 keeps the original name
+func (f *storeFlags) fingerPrintCol() string {
+	if *f.algo == img.AlgoSHA256 {
+		return fingerPrintCollection
+	}
+	return fingerPrintCollection + "." + *f.algo
+}
+
+// contentCol returns the content hash collection, or "" when the content tier is off
+func (f *storeFlags) contentCol() string {
+	if !*f.exact {
+		return ""
+	}
+	return contentCollection
+}
+
+// cols returns the collections the flags select
+func (f *storeFlags) cols() []string {
+	if c := f.contentCol(); c != "" {
+		return []string{f.fingerPrintCol(), c}
+	}
+	return []string{f.fingerPrintCol()}
+}
+
+// addKeepFlag registers the repeatable flag of the keeper policies
+func addKeepFlag(fset *flag.FlagSet) *keeper.Chain {
+	keep := &keeper.Chain{}
+	fset.Var(keep, "keep", "keeper policy, repeat to break ties in order: "+strings.Join(keeper.Names, ", ")+" (default \""+keeper.Default.String()+"\")")
+	return keep
+}
+
+// addSniffFlag registers the flag that also finds images by content when their extension misses
+func addSniffFlag(fset *flag.FlagSet) *bool {
+	return fset.Bool("sniff", false, "also find the images their extension misses by the first bytes of the file; reads every other file")
+}
+
+// validAlgo reports whether algo is a known fingerprint algorithm
+func validAlgo(algo string) bool {
+	for _, a := range img.Algorithms {
+		if a == algo {
+			return true
+		}
+	}
+	return false
+}
+
+func scanCommand(fset *flag.FlagSet) func([]string) (bool, error) {
+	store := addStoreFlags(fset)
+	threshold := fset.Int("threshold", 0, "maximum number of differing fingerprint bits for images to be duplicates")
+	workers := fset.Int("workers", runtime.NumCPU(), "number of images to decode and fingerprint at once")
+	memory := fset.Int64("mem", 1024, "maximum MiB of decoded pixels to hold at once (0 for no limit)")
+	keep := addKeepFlag(fset)
+	sniff := addSniffFlag(fset)
+
+	return func(dirs []string) (bool, error) {
+		if len(dirs) == 0 {
+			return false, usageError("no directories specified")
+		}
+		if *threshold < 0 {
+			return false, usageError("threshold must not be negative")
+		}
+		if *workers < 1 || *memory < 0 {
+			return false, usageError("workers must be at least 1 and mem must not be negative")
+		}
+
+		ds, err := store.open()
+		if err != nil {
+			return false, err
+		}
+		defer ds.Close()
+
+		scanStats, err := DupeDetectRun(DupeDetectConfig{
+			Dirs:           dirs,
+			Datastore:      ds,
+			FingerPrintCol: store.fingerPrintCol(),
+			Algorithm:      *store.algo,
+			Threshold:      *threshold,
+			ContentCol:     store.contentCol(),
+			Workers:        *workers,
+			MemoryBudget:   *memory << 20,
+			Keep:           *keep,
+			Sniff:          *sniff,
+		})
+		if err != nil {
+			return false, err
+		}
+		return scanStats.DuplicatesFound > 0, nil
+	}
+}
+
+func reportCommand(fset *flag.FlagSet) func([]string) (bool, error) {
+	store := addStoreFlags(fset)
+	threshold := fset.Int("threshold", 0, "maximum number of differing fingerprint bits for images to be duplicates")
+	format := fset.String("format", FormatText, "report format: "+FormatText+", "+strings.Join(report.Formats, ", ")+", "+report.FormatHTML)
+	out := fset.String("out", "", "file to write the report to instead of stdout; the directory of an html report")
+	keep := addKeepFlag(fset)
+
+	return func(args []string) (bool, error) {
+		if len(args) > 0 {
+			return false, usageError("report takes no arguments")
+		}
+		if *threshold < 0 {
+			return false, usageError("threshold must not be negative")
+		}
+		if !validFormat(*format) {
+			return false, usageError("unknown report format: " + *format)
+		}
+		if *format == report.FormatHTML && *out == "" {
+			return false, usageError("an html report needs an -out directory")
+		}
+
+		var file string
+		if *format != report.FormatHTML {
+			file = *out
+		}
+
+		ds, err := store.open()
+		if err != nil {
+			return false, err
+		}
+		defer ds.Close()
+
+		n, err := ReportRun(ReportConfig{
+			Datastore:      ds,
+			FingerPrintCol: store.fingerPrintCol(),
+			Algorithm:      *store.algo,
+			Threshold:      *threshold,
+			ContentCol:     store.contentCol(),
+			Format:         *format,
+			Out:            os.Stdout,
+			File:           file,
+			Dir:            *out,
+			Keep:           *keep,
+		})
+		if err != nil {
+			return false, err
+		}
+		return n > 0, nil
+	}
+}
+
+func applyCommand(fset *flag.FlagSet) func([]string) (bool, error) {
+	store := addStoreFlags(fset)
+	threshold := fset.Int("threshold", 0, "maximum number of differing fingerprint bits for images to be duplicates")
+	keep := addKeepFlag(fset)
+	action := fset.String("action", "", "what to do to the duplicates that are not kept: "+strings.Join(Actions, ", "))
+	quarantine := fset.String("quarantine", "", "directory the quarantine action moves duplicates to")
+	stash := fset.String("stash", "", "directory other actions keep duplicates that differ from their keeper in, for undo (default the datastore path plus .stash)")
+	dryRun := fset.Bool("dry-run", false, "only report what would be done")
+
+	return func(args []string) (bool, error) {
+		if len(args) > 0 {
+			return false, usageError("apply takes no arguments")
+		}
+		if *threshold < 0 {
+			return false, usageError("threshold must not be negative")
+		}
+		if !validAction(*action) {
+			return false, usageError("unknown action: " + *action)
+		}
+		if *action == ActionQuarantine && *quarantine == "" {
+			return false, usageError("the quarantine action needs a -quarantine directory")
+		}
+
+		if *stash == "" {
+			*stash = *store.path + ".stash"
+		}
+
+		ds, err := store.open()
+		if err != nil {
+			return false, err
+		}
+		defer ds.Close()
+
+		_, err = ApplyRun(ApplyConfig{
+			Datastore:      ds,
+			FingerPrintCol: store.fingerPrintCol(),
+			Algorithm:      *store.algo,
+			Threshold:      *threshold,
+			ContentCol:     store.contentCol(),
+			Keep:           *keep,
+			Action:         *action,
+			Quarantine:     *quarantine,
+			Stash:          *stash,
+			DryRun:         *dryRun,
+		})
+		return false, err
+	}
+}
+
+func undoCommand(fset *flag.FlagSet) func([]string) (bool, error) {
+	store := addStoreFlags(fset)
+	run := fset.String("run", "", "journal run to undo (default the last run with entries left to undo)")
+	list := fset.Bool("list", false, "list the journal runs, or the entries of -run, instead of undoing anything")
+	dryRun := fset.Bool("dry-run", false, "only report what would be restored")
+
+	return func(args []string) (bool, error) {
+		var seqs []uint64
+		for _, a := range args {
+			seq, err := strconv.ParseUint(a, 10, 64)
+			if err != nil {
+				return false, usageError("invalid journal entry: " + a)
+			}
+			seqs = append(seqs, seq)
+		}
+		if len(seqs) > 0 && *run == "" {
+			return false, usageError("selecting entries needs a -run")
+		}
+
+		ds, err := store.open()
+		if err != nil {
+			return false, err
+		}
+		defer ds.Close()
+
+		if *list {
+			return false, ListJournal(os.Stdout, ds, *run)
+		}
+
+		sum, err := UndoRun(UndoConfig{
+			Datastore: ds,
+			Cols:      store.cols(),
+			Run:       *run,
+			Seqs:      seqs,
+			DryRun:    *dryRun,
+		})
+		if err == nil && sum.Failed > 0 {
+			err = fmt.Errorf("%d entries could not be undone", sum.Failed)
+		}
+		return false, err
+	}
+}
+
+func queryCommand(fset *flag.FlagSet) func([]string) (bool, error) {
+	store := addStoreFlags(fset)
+	threshold := fset.Int("threshold", 0, "maximum number of differing fingerprint bits for images to be duplicates")
+
+	return func(paths []string) (bool, error) {
+		if len(paths) == 0 {
+			return false, usageError("no images specified")
+		}
+		if *threshold < 0 {
+			return false, usageError("threshold must not be negative")
+		}
+
+		ds, err := store.open()
+		if err != nil {
+			return false, err
+		}
+		defer ds.Close()
+
+		return QueryRun(QueryConfig{
+			Paths:          paths,
+			Datastore:      ds,
+			FingerPrintCol: store.fingerPrintCol(),
+			Algorithm:      *store.algo,
+			Threshold:      *threshold,
+		})
+	}
+}
+
+func pruneCommand(fset *flag.FlagSet) func([]string) (bool, error) {
+	store := addStoreFlags(fset)
+	dryRun := fset.Bool("dry-run", false, "only report what would be removed")
+
+	return func(args []string) (bool, error) {
+		if len(args) > 0 {
+			return false, usageError("prune takes no arguments")
+		}
+
+		ds, err := store.open()
+		if err != nil {
+			return false, err
+		}
+		defer ds.Close()
+
+		_, err = PruneRun(PruneConfig{
+			Datastore: ds,
+			Cols:      store.cols(),
+			DryRun:    *dryRun,
+		})
+		return false, err
+	}
+}
+
+func clearCommand(fset *flag.FlagSet) func([]string) (bool, error) {
+	store := addStoreFlags(fset)
+	yes := fset.Bool("yes", false, "do not ask for confirmation")
+
+	return func(dirs []string) (bool, error) {
+		ds, err := store.open()
+		if err != nil {
+			return false, err
+		}
+		defer ds.Close()
+
+		_, err = ClearRun(ClearConfig{
+			Datastore: ds,
+			Cols:      store.cols(),
+			Dirs:      dirs,
+			Yes:       *yes,
+			In:        os.Stdin,
+			Out:       os.Stdout,
+		})
+		return false, err
+	}
+}
+
+func relocateCommand(fset *flag.FlagSet) func([]string) (bool, error) {
+	from := fset.String("from", "", "relocate images from path")
+	to := fset.String("to", "", "relocate images to path")
+	mode := fset.String("mode", ModeCopy, "copy or move the images: "+ModeCopy+", "+ModeMove)
+	lay := fset.String("layout", layout.Default, "template of the path of an image under -to, with the variables {"+strings.Join(layout.Names, "}, {")+"}")
+	store := addStoreFlags(fset)
+	dupes := fset.String("dupes", DupesOff, "what to do with images that duplicate one of the datastore under -to: "+DupesOff+", "+DupesSkip+", "+DupesRoute)
+	threshold := fset.Int("threshold", 0, "maximum number of differing fingerprint bits for images to be duplicates")
+	dates := fset.String("dates", strings.Join(img.DateSources, ","), "comma separated date sources tried in order: "+strings.Join(img.DateSources, ", "))
+	dryRun := fset.Bool("dry-run", false, "only print the source and target of every image")
+	sniff := addSniffFlag(fset)
+
+	return func(args []string) (bool, error) {
+		if len(args) > 0 {
+			return false, usageError("relocate takes no arguments")
+		}
+		if *from == "" || *to == "" {
+			return false, usageError("must specify relocate from and relocate to")
+		}
+		if _, err := os.Stat(*from); os.IsNotExist(err) {
+			return false, errors.New("from directory does not exist: " + *from)
+		}
+		if _, err := os.Stat(*to); os.IsNotExist(err) {
+			return false, errors.New("to directory does not exist: " + *to)
+		}
+		if inTree(*to, *from) || inTree(*from, *to) {
+			return false, usageError("from and to must not be the same directory or one inside the other")
+		}
+		if *mode != ModeCopy && *mode != ModeMove {
+			return false, usageError("unknown relocation mode: " + *mode)
+		}
+		if _, err := layout.Parse(*lay); err != nil {
+			return false, usageError(err.Error())
+		}
+		if !validAlgo(*store.algo) {
+			return false, usageError("unknown fingerprint algorithm: " + *store.algo)
+		}
+		if *dupes != DupesOff && *dupes != DupesSkip && *dupes != DupesRoute {
+			return false, usageError("unknown duplicate handling: " + *dupes)
+		}
+		if *threshold < 0 {
+			return false, usageError("threshold must not be negative")
+		}
+		sources, err := img.ParseDateSources(*dates)
+		if err != nil {
+			return false, usageError(err.Error())
+		}
+
+		cfg := ReloConfig{
+			From:           *from,
+			To:             *to,
+			Mode:           *mode,
+			Layout:         *lay,
+			Algorithm:      *store.algo,
+			DateSources:    sources,
+			Dupes:          *dupes,
+			FingerPrintCol: store.fingerPrintCol(),
+			Threshold:      *threshold,
+			DryRun:         *dryRun,
+			Sniff:          *sniff,
+		}
+		if *dupes != DupesOff {
+			ds, err := store.open()
+			if err != nil {
+				return false, err
+			}
+			defer ds.Close()
+			cfg.Datastore = ds
+		}
+
+		return false, ReloRun(cfg)
+	}
+}
+
+func serveCommand(fset *flag.FlagSet) func([]string) (bool, error) {
+	store := addStoreFlags(fset)
+	listen := fset.String("listen", "127.0.0.1:8228", "interface to listen on")
+	static := fset.String("static", here("static"), "path where static files (html, css, js) are located")
+
+	return func(dirs []string) (bool, error) {
+		log.Debugf("static dir: %s", *static)
+
+		ds, err := store.open()
+		if err != nil {
+			return false, err
+		}
+		defer ds.Close()
+
+		return false, ui.Serve(ui.Config{
+			Dirs:           dirs,
+			Listen:         *listen,
+			Static:         *static,
+			Datastore:      ds,
+			FingerPrintCol: store.fingerPrintCol(),
+		})
+	}
+}
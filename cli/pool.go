@@ -0,0 +1,196 @@
+package cli
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/marklap/imgdupdetect/datastore"
+	"github.com/marklap/imgdupdetect/fs"
+	"github.com/marklap/imgdupdetect/img"
+	"github.com/marklap/imgdupdetect/keeper"
+	"github.com/marklap/imgdupdetect/match"
+	"github.com/marklap/imgdupdetect/stats"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// batchSize is the number of fingerprints written to the datastore per transaction
+	batchSize = 256
+	// bytesPerPixel is the estimated decoded size of a pixel, used to charge the memory budget
+	bytesPerPixel = 4
+)
+
+// budget is a counting semaphore over the bytes of decoded pixel data held at once
+type budget struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	free  int64
+	total int64
+}
+
+// newBudget creates a budget of total bytes
+func newBudget(total int64) *budget {
+	b := &budget{free: total, total: total}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire blocks until n bytes are free and takes them; a request for more than the whole budget
+// waits for all of it, so the image is decoded on its own. It returns the amount to release.
+func (b *budget) acquire(n int64) int64 {
+	if n > b.total {
+		n = b.total
+	}
+	b.mu.Lock()
+	for b.free < n {
+		b.cond.Wait()
+	}
+	b.free -= n
+	b.mu.Unlock()
+	return n
+}
+
+// release returns n bytes to the budget
+func (b *budget) release(n int64) {
+	b.mu.Lock()
+	b.free += n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// fingerPrintAll fingerprints the images with cfg.Workers decoders and writes the results to the
+// datastore from a single goroutine in batches
+func fingerPrintAll(cfg DupeDetectConfig, paths []string, scanStats *stats.ScanStats) error {
+	workers := cfg.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	mem := newBudget(cfg.MemoryBudget)
+
+	jobs := make(chan string)
+	results := make(chan datastore.Entry, workers)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range jobs {
+				e, err := fingerPrintFile(cfg, path, mem)
+				if err != nil {
+					log.Error(err)
+					continue
+				}
+				results <- e
+			}
+		}()
+	}
+
+	go func() {
+		for _, path := range paths {
+			jobs <- path
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	var total, failed int
+	var batch []datastore.Entry
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		n := storeBatch(cfg.Datastore, cfg.FingerPrintCol, batch)
+		scanStats.AddFingerPrintCount(len(batch) - n)
+		total += len(batch)
+		failed += n
+		batch = batch[:0]
+	}
+	for e := range results {
+		batch = append(batch, e)
+		if len(batch) >= batchSize {
+			flush()
+		}
+	}
+	flush()
+
+	if failed > 0 {
+		return fmt.Errorf("cannot store the fingerprints of %d of %d images", failed, total)
+	}
+	return nil
+}
+
+// storeBatch writes a batch of fingerprints in one transaction. When that fails, nothing of it
+// was written, so the entries are written one by one and only the ones that fail are lost. It
+// returns their number.
+func storeBatch(ds *datastore.Datastore, col string, batch []datastore.Entry) int {
+	err := ds.AddBatch(col, batch)
+	if err == nil {
+		return 0
+	}
+	log.Errorf("cannot store a batch of %d fingerprints, storing them one by one: %s", len(batch), err)
+
+	var failed int
+	for _, e := range batch {
+		if err := ds.Add(col, e.FingerPrint, e.Name, e.Data); err != nil {
+			log.Errorf("cannot store the fingerprint of %s: %s", e.Name, err)
+			failed++
+		}
+	}
+	return failed
+}
+
+// fingerPrintFile decodes and fingerprints one image within the memory budget
+func fingerPrintFile(cfg DupeDetectConfig, path string, mem *budget) (datastore.Entry, error) {
+	i, err := img.NewImage(path)
+	if err != nil {
+		return datastore.Entry{}, err
+	}
+
+	meta := map[string][]byte{
+		datastore.MetaSize:    i.SizeByteSlice(),
+		datastore.MetaModTime: datastore.Uint64Bytes(uint64(i.FileInfo.ModTime().UnixNano())),
+		datastore.MetaInode:   datastore.Uint64Bytes(fs.Inode(i.FileInfo)),
+		"height":              i.HeightByteSlice(),
+		"width":               i.WidthByteSlice(),
+		"orientation":         i.OrientationByteSlice(),
+	}
+	// a zero date records that the image has none, so reports need not look again
+	dt, err := i.ExifDateTime()
+	if err != nil || dt.IsZero() {
+		meta[keeper.MetaDateTime] = datastore.Uint64Bytes(0)
+	} else {
+		meta[keeper.MetaDateTime] = datastore.Uint64Bytes(uint64(dt.UnixNano()))
+	}
+
+	fper, err := img.NewFingerPrinter(cfg.Algorithm, i)
+	if err != nil {
+		return datastore.Entry{}, err
+	}
+
+	held := mem.acquire(int64(i.Config.Width) * int64(i.Config.Height) * bytesPerPixel)
+	defer mem.release(held)
+
+	var fp []byte
+	switch f := fper.(type) {
+	case img.CanonicalFingerPrinter:
+		var t img.Transform
+		fp, t, err = f.Canonical()
+		meta[match.MetaTransform] = []byte{byte(t)}
+	case img.KeyPointFingerPrinter:
+		var kps *img.KeyPointSet
+		fp, kps, err = f.FingerPrintKeyPoints()
+		if err == nil {
+			meta[match.MetaKeyPoints] = img.EncodeKeyPoints(kps)
+		}
+	default:
+		fp, err = fper.FingerPrint()
+	}
+	if err != nil {
+		return datastore.Entry{}, err
+	}
+
+	return datastore.Entry{FingerPrint: fp, Name: path, Data: meta}, nil
+}
@@ -0,0 +1,32 @@
+package cli
+
+import (
+	"os"
+	"testing"
+
+	"github.com/marklap/imgdupdetect/datastore"
+)
+
+func TestStoreBatch(t *testing.T) {
+	dir, ds := tstDir(t)
+	defer os.RemoveAll(dir)
+	defer ds.Close()
+
+	// the entry without a fingerprint fails the transaction of the whole batch
+	batch := []datastore.Entry{
+		{FingerPrint: []byte{1}, Name: "/tmp/a.jpg"},
+		{Name: "/tmp/b.jpg"},
+		{FingerPrint: []byte{2}, Name: "/tmp/c.jpg"},
+	}
+	if got := storeBatch(ds, tstFingerPrintCol, batch); got != 1 {
+		t.Errorf("failed count mismatch - want: 1, got: %d", got)
+	}
+	for _, name := range []string{"/tmp/a.jpg", "/tmp/c.jpg"} {
+		if rec, err := ds.GetPath(tstFingerPrintCol, name); err != nil || rec == nil {
+			t.Errorf("%s not stored after the batch failed (%v)", name, err)
+		}
+	}
+	if got := ds.GetFingerPrints(tstFingerPrintCol); len(got) != 2 {
+		t.Errorf("fingerprint count mismatch - want: 2, got: %d", len(got))
+	}
+}
@@ -0,0 +1,128 @@
+package cli
+
+import (
+	"os"
+
+	"github.com/marklap/imgdupdetect/datastore"
+	"github.com/marklap/imgdupdetect/img"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PruneConfig is the prune CLI config
+type PruneConfig struct {
+
+	// Datastore is the datastore
+	Datastore *datastore.Datastore
+	// Cols are the names of the collections to prune
+	Cols []string
+	// DryRun reports what would be removed without removing it
+	DryRun bool
+}
+
+// PruneSummary counts what a prune removed
+type PruneSummary struct {
+	Missing      int
+	Changed      int
+	FingerPrints int
+}
+
+// PruneRun removes the stored files that no longer exist or no longer match their stored size
+// and modification time, the pages multi-page TIFFs no longer have, and the fingerprints left
+// without files
+func PruneRun(cfg PruneConfig) (PruneSummary, error) {
+	var sum PruneSummary
+	verb := "removed"
+	if cfg.DryRun {
+		verb = "would remove"
+	}
+
+	// the pages of every file with a page stored, read once per file
+	pages := make(map[string][]string)
+
+	for _, col := range cfg.Cols {
+		log.Infof("pruning %s...", col)
+		for _, fp := range cfg.Datastore.GetFingerPrints(col) {
+			files, err := cfg.Datastore.Get(col, fp)
+			if err != nil {
+				return sum, err
+			}
+
+			left := len(files)
+			for name, meta := range files {
+				reason := staleReason(name, meta, pages)
+				if reason == "" {
+					continue
+				}
+
+				log.Infof("  - %s %s file: %s", verb, reason, name)
+				if reason != "changed" {
+					sum.Missing++
+				} else {
+					sum.Changed++
+				}
+				left--
+
+				if cfg.DryRun {
+					continue
+				}
+				err := cfg.Datastore.Remove(col, fp, name)
+				if err != nil {
+					return sum, err
+				}
+			}
+
+			// Remove drops a fingerprint with its last file; count those too
+			if left == 0 && len(files) > 0 {
+				sum.FingerPrints++
+			}
+		}
+
+		if !cfg.DryRun {
+			n, err := cfg.Datastore.RemoveEmpty(col)
+			if err != nil {
+				return sum, err
+			}
+			sum.FingerPrints += n
+		}
+	}
+
+	log.Infof("%s %d missing and %d changed files and %d empty fingerprints", verb, sum.Missing, sum.Changed, sum.FingerPrints)
+	return sum, nil
+}
+
+// staleReason returns why a stored file should be pruned, or "" when it is still current. The
+// pages of the files pages are stored for are looked up in pages and added to it.
+func staleReason(name string, meta map[string][]byte, pages map[string][]string) string {
+	file, page := img.SplitPage(name)
+	fi, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return "missing"
+	}
+	if err != nil {
+		log.Error(err)
+		return ""
+	}
+
+	// a TIFF that lost pages may still have the size and modification time it was stored with
+	if page > 0 {
+		if _, found := pages[file]; !found {
+			pages[file] = img.Pages(file)
+		}
+		var kept bool
+		for _, p := range pages[file] {
+			kept = kept || p == name
+		}
+		if !kept {
+			return "missing page"
+		}
+	}
+
+	if v, found := meta[datastore.MetaSize]; found && len(v) == 8 && datastore.Uint64Value(v) != uint64(fi.Size()) {
+		return "changed"
+	}
+	if v, found := meta[datastore.MetaModTime]; found && len(v) == 8 && int64(datastore.Uint64Value(v)) != fi.ModTime().UnixNano() {
+		return "changed"
+	}
+	return ""
+}
@@ -0,0 +1,48 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/marklap/imgdupdetect/datastore"
+	"github.com/marklap/imgdupdetect/img"
+)
+
+func TestPruneLostPages(t *testing.T) {
+	dir, ds := tstDir(t)
+	defer os.RemoveAll(dir)
+	defer ds.Close()
+
+	a := filepath.Join(dir, "a.png")
+	writePNG(t, a, 32, 32, hGradient)
+	scan(t, ds, dir)
+	rec, err := ds.GetPath(tstFingerPrintCol, a)
+	if err != nil || rec == nil {
+		t.Fatalf("file not fingerprinted - got: %v (%v)", rec, err)
+	}
+
+	// the second page of a file that has a single page now, with the size and time it still has
+	page := img.PageName(a, 2)
+	meta := map[string][]byte{
+		datastore.MetaSize:    datastore.Uint64Bytes(uint64(rec.Size)),
+		datastore.MetaModTime: datastore.Uint64Bytes(uint64(rec.ModTime)),
+	}
+	if err := ds.Add(tstFingerPrintCol, []byte("page"), page, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	sum, err := PruneRun(PruneConfig{Datastore: ds, Cols: []string{tstFingerPrintCol}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum.Missing != 1 || sum.Changed != 0 {
+		t.Errorf("pruned files mismatch - want: 1 missing 0 changed, got: %d missing %d changed", sum.Missing, sum.Changed)
+	}
+	if rec, _ := ds.GetPath(tstFingerPrintCol, page); rec != nil {
+		t.Errorf("lost page not pruned - got: %v", rec)
+	}
+	if rec, _ := ds.GetPath(tstFingerPrintCol, a); rec == nil {
+		t.Errorf("current file pruned")
+	}
+}
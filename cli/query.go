@@ -0,0 +1,75 @@
+package cli
+
+import (
+	"github.com/marklap/imgdupdetect/datastore"
+	"github.com/marklap/imgdupdetect/img"
+	"github.com/marklap/imgdupdetect/index"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// QueryConfig is the query CLI config
+type QueryConfig struct {
+
+	// Paths are the images to look up
+	Paths []string
+	// Datastore is the datastore
+	Datastore *datastore.Datastore
+	// FingerPrintCol is the name of the collection to look in
+	FingerPrintCol string
+	// Algorithm is the name of the fingerprint algorithm the collection was built with
+	Algorithm string
+	// Threshold is the number of differing fingerprint bits still considered a duplicate
+	Threshold int
+}
+
+// QueryRun fingerprints the given images without storing them and logs the stored images that are
+// duplicates of each. It reports whether any duplicates were found.
+func QueryRun(cfg QueryConfig) (bool, error) {
+	if _, err := img.NewFingerPrinter(cfg.Algorithm, nil); err != nil {
+		return false, err
+	}
+
+	ix, err := index.Open(cfg.Datastore, cfg.FingerPrintCol)
+	if err != nil {
+		return false, err
+	}
+
+	fpCfg := DupeDetectConfig{Algorithm: cfg.Algorithm}
+	mem := newBudget(0)
+
+	var found bool
+	for _, path := range cfg.Paths {
+		e, err := fingerPrintFile(fpCfg, path, mem)
+		if err != nil {
+			return found, err
+		}
+
+		fps, err := ix.Search(e.FingerPrint, cfg.Threshold)
+		if err != nil {
+			return found, err
+		}
+
+		var matches []string
+		for _, fp := range fps {
+			for _, name := range cfg.Datastore.GetImages(cfg.FingerPrintCol, fp) {
+				if name == path {
+					continue
+				}
+				matches = append(matches, name)
+				log.Debugf("%s is within %d bits of %s", name, img.Distance(e.FingerPrint, fp), path)
+			}
+		}
+
+		if len(matches) == 0 {
+			log.Infof("no duplicates of %s", path)
+			continue
+		}
+		found = true
+		log.Infof("found duplicates of %s:", path)
+		for _, name := range matches {
+			log.Infof("  - %s", name)
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,518 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/marklap/imgdupdetect/datastore"
+	"github.com/marklap/imgdupdetect/fs"
+	"github.com/marklap/imgdupdetect/img"
+	"github.com/marklap/imgdupdetect/index"
+	"github.com/marklap/imgdupdetect/layout"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/mknote"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// uuid returns 12 random hex digits
+func uuid() (string, error) {
+	buf := make([]byte, 6)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%012x", buf), nil
+}
+
+// Relocation modes
+const (
+	// ModeCopy copies the images and leaves the originals in place
+	ModeCopy = "copy"
+	// ModeMove moves the images
+	ModeMove = "move"
+)
+
+// What relocation does with images that duplicate one already in the target tree
+const (
+	// DupesOff relocates every image without looking for duplicates
+	DupesOff = "off"
+	// DupesSkip leaves duplicates where they are
+	DupesSkip = "skip"
+	// DupesRoute relocates duplicates into the layout.Duplicates folder
+	DupesRoute = "route"
+)
+
+// MetaDateSource is the metadata key of the img date source a relocated image was dated from;
+// the value is empty when none of the sources knew its date
+const MetaDateSource = "datesource"
+
+// ReloConfig is the relocation CLI config
+type ReloConfig struct {
+
+	// From is the directory of the source images
+	From string
+	// To is the target directory
+	To string
+	// Mode is ModeCopy or ModeMove
+	Mode string
+	// Layout is the template of the path of an image under To; empty uses layout.Default
+	Layout string
+	// Algorithm is the fingerprint algorithm of the {fp} layout variable and of FingerPrintCol
+	Algorithm string
+	// DateSources are the img date sources tried in order for the date an image was taken;
+	// empty uses img.DateSources
+	DateSources []string
+	// Dupes is DupesOff, DupesSkip or DupesRoute; empty is DupesOff
+	Dupes string
+	// Datastore is the datastore that knows the images under To; only used to find duplicates
+	Datastore *datastore.Datastore
+	// FingerPrintCol is the name of the collection of the images under To
+	FingerPrintCol string
+	// Threshold is the number of differing fingerprint bits still considered a duplicate
+	Threshold int
+	// DryRun prints the source and target of every image without touching any file
+	DryRun bool
+	// Sniff also finds the images their extension does not name, by their content
+	Sniff bool
+}
+
+// reloDupe is an image that duplicates one already in the target tree
+type reloDupe struct {
+	path     string
+	existing string
+	distance int
+	exact    bool
+}
+
+// reloImport is an image relocated by the current run
+type reloImport struct {
+	source string
+	target string
+	fp     []byte
+}
+
+// ReloRun copies or moves the images under From to the path Layout gives them under To. Images
+// none of the date sources knows a date for go to the layout.Undated folder when Layout needs a
+// date. Every copy is synced and verified against the hash of its source before it appears under
+// its final name, and moves only remove the source after that. Images that cannot be relocated
+// are logged and counted; the returned error reports how many there were. An image whose target
+// already holds the same content was relocated before and is left alone, so an import can be
+// run again.
+//
+// Unless Dupes is DupesOff every image is fingerprinted and looked up among the images of
+// FingerPrintCol under To and the images relocated before it; images the decoders cannot read
+// are relocated without the check. Duplicates are skipped or routed
+// as Dupes says and reported with the image they matched; the other images are added to the
+// collection under their new path, so the next import knows them.
+func ReloRun(cfg ReloConfig) error {
+	log.Debug("relo from: ", cfg.From)
+	log.Debug("relo to: ", cfg.To)
+
+	if cfg.Mode != ModeCopy && cfg.Mode != ModeMove {
+		return fmt.Errorf("unknown relocation mode: %s", cfg.Mode)
+	}
+	if cfg.Dupes == "" {
+		cfg.Dupes = DupesOff
+	}
+	if cfg.Dupes != DupesOff && cfg.Dupes != DupesSkip && cfg.Dupes != DupesRoute {
+		return fmt.Errorf("unknown duplicate handling: %s", cfg.Dupes)
+	}
+	if cfg.Layout == "" {
+		cfg.Layout = layout.Default
+	}
+	tmpl, err := layout.Parse(cfg.Layout)
+	if err != nil {
+		return err
+	}
+	undated, err := layout.Parse(layout.Undated)
+	if err != nil {
+		return err
+	}
+	dupes, err := layout.Parse(layout.Duplicates)
+	if err != nil {
+		return err
+	}
+	if len(cfg.DateSources) == 0 {
+		cfg.DateSources = img.DateSources
+	}
+	if _, err := img.NewFingerPrinter(cfg.Algorithm, nil); err != nil {
+		return err
+	}
+
+	var ix *index.Index
+	if cfg.Dupes != DupesOff {
+		if cfg.Datastore == nil {
+			return fmt.Errorf("looking for duplicates needs a datastore")
+		}
+		if ix, err = index.Open(cfg.Datastore, cfg.FingerPrintCol); err != nil {
+			return err
+		}
+	}
+
+	p, err := fs.NewPath(cfg.From, imageMatchers(cfg.Sniff))
+	if err != nil {
+		return err
+	}
+
+	imgPaths, err := p.Find()
+	if err != nil {
+		return err
+	}
+
+	exif.RegisterParsers(mknote.All...)
+
+	// the sources of the targets planned in this run, so a dry run numbers collisions the way a
+	// real one would
+	planned := make(map[string]string)
+	// images relocated in this run, so duplicates among the imported images are found in a dry run
+	// too, before any of them is in the datastore
+	var imported []reloImport
+	mem := newBudget(0)
+	fpCfg := DupeDetectConfig{Algorithm: cfg.Algorithm}
+
+	var relocated, already, failed int
+	var found []reloDupe
+	sources := make(map[string]int)
+	for _, path := range imgPaths {
+		var e *datastore.Entry
+		if ix != nil {
+			// images the decoders do not understand cannot be compared, so they are relocated
+			// as they would be without looking for duplicates
+			if entry, err := fingerPrintFile(fpCfg, path, mem); err != nil {
+				log.Errorf("cannot look for duplicates of %s: %s", path, err)
+			} else {
+				e = &entry
+			}
+		}
+
+		// the variables are read for every layout the image may end up in
+		tmpls := []*layout.Template{tmpl}
+		if tmpl.UsesDate() {
+			tmpls = append(tmpls, undated)
+		}
+		if e != nil && cfg.Dupes == DupesRoute {
+			tmpls = append(tmpls, dupes)
+		}
+		vars, err := reloVars(cfg, path, e, tmpls...)
+		if err != nil {
+			log.Errorf("%s: %s", path, err)
+			failed++
+			continue
+		}
+
+		t := tmpl
+		if vars.Taken.IsZero() && tmpl.UsesDate() {
+			t = undated
+		}
+		target, done, err := reloTarget(cfg.To, t, vars, path, planned)
+		if err != nil {
+			log.Errorf("%s: %s", path, err)
+			failed++
+			continue
+		}
+		// an image relocated before would be found as a duplicate of its own copy, so this is
+		// settled first
+		if done {
+			log.Infof("%s is already relocated as %s", path, target)
+			already++
+			continue
+		}
+
+		var dupe *reloDupe
+		if e != nil {
+			if dupe, err = reloDuplicate(cfg, ix, imported, *e); err != nil {
+				return err
+			}
+		}
+		if dupe != nil {
+			if cfg.Dupes == DupesSkip {
+				found = append(found, *dupe)
+				log.Infof("skipping %s: %s", path, dupe)
+				continue
+			}
+			target, done, err = reloTarget(cfg.To, dupes, vars, path, planned)
+			if err != nil {
+				log.Errorf("%s: %s", path, err)
+				failed++
+				continue
+			}
+			if done {
+				log.Infof("%s is already relocated as %s", path, target)
+				already++
+				continue
+			}
+			found = append(found, *dupe)
+		}
+		planned[target] = path
+		if e != nil && dupe == nil {
+			imported = append(imported, reloImport{source: path, target: target, fp: e.FingerPrint})
+		}
+
+		if cfg.DryRun {
+			fmt.Println(path, target)
+			continue
+		}
+
+		if cfg.Mode == ModeMove {
+			err = fs.Move(path, target)
+		} else {
+			err = fs.CopyVerified(path, target)
+		}
+		if err != nil {
+			log.Errorf("%s: %s", path, err)
+			failed++
+			continue
+		}
+		switch {
+		case dupe != nil:
+			log.Infof("%s %s to %s: %s", cfg.Mode, path, target, dupe)
+		case vars.DateSource == "":
+			log.Infof("%s %s to %s (undated)", cfg.Mode, path, target)
+		default:
+			log.Infof("%s %s to %s (date from %s)", cfg.Mode, path, target, vars.DateSource)
+		}
+		sources[vars.DateSource]++
+		relocated++
+
+		if e != nil && dupe == nil {
+			if err := remember(cfg, *e, target, vars.DateSource); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !cfg.DryRun {
+		log.Infof("relocated %d images; %d were already; %d failed", relocated, already, failed)
+		for _, src := range cfg.DateSources {
+			if sources[src] > 0 {
+				log.Infof(" - %d dated from %s", sources[src], src)
+			}
+		}
+		if sources[""] > 0 {
+			log.Infof(" - %d undated", sources[""])
+		}
+	}
+	if len(found) > 0 {
+		if cfg.Dupes == DupesRoute {
+			log.Infof("routed %d duplicates to %s:", len(found), filepath.Join(cfg.To, filepath.Dir(layout.Duplicates)))
+		} else {
+			log.Infof("skipped %d duplicates:", len(found))
+		}
+		for _, d := range found {
+			log.Infof("  - %s: %s", d.path, d)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d images could not be relocated", failed)
+	}
+	return nil
+}
+
+// String describes what the duplicate matched
+func (d reloDupe) String() string {
+	if d.exact {
+		return "exact copy of " + d.existing
+	}
+	return fmt.Sprintf("duplicate of %s (%d bits apart)", d.existing, d.distance)
+}
+
+// reloDuplicate returns the closest image that e duplicates among the images of the collection
+// under cfg.To and the images imported before it, or nil when there is none. Images the
+// collection remembers but that are gone from disk do not count.
+func reloDuplicate(cfg ReloConfig, ix *index.Index, imported []reloImport, e datastore.Entry) (*reloDupe, error) {
+	var best *reloDupe
+	// content is the file that has the content of the best match; an image imported in a dry run
+	// or by a failed copy only exists at its source
+	var content string
+	consider := func(name, file string, fp []byte) {
+		d := img.Distance(e.FingerPrint, fp)
+		if best != nil && best.distance <= d {
+			return
+		}
+		best = &reloDupe{path: e.Name, existing: name, distance: d}
+		content = file
+	}
+
+	fps, err := ix.Search(e.FingerPrint, cfg.Threshold)
+	if err != nil {
+		return nil, err
+	}
+	for _, fp := range fps {
+		for _, name := range cfg.Datastore.GetImages(cfg.FingerPrintCol, fp) {
+			if name == e.Name || !inTree(name, cfg.To) || inTree(name, filepath.Join(cfg.To, filepath.Dir(layout.Duplicates))) {
+				continue
+			}
+			file, _ := img.SplitPage(name)
+			if _, err := os.Stat(file); err != nil {
+				continue
+			}
+			consider(name, file, fp)
+		}
+	}
+	for _, i := range imported {
+		if img.Distance(e.FingerPrint, i.fp) > cfg.Threshold {
+			continue
+		}
+		file := i.target
+		if _, err := os.Stat(file); err != nil {
+			file = i.source
+		}
+		consider(i.target, file, i.fp)
+	}
+
+	if best != nil && best.distance == 0 {
+		a, errA := fs.ContentHash(e.Name)
+		b, errB := fs.ContentHash(content)
+		best.exact = errA == nil && errB == nil && bytes.Equal(a, b)
+	}
+	return best, nil
+}
+
+// remember adds a relocated image to the collection under its new path, with the date source it
+// was dated from
+func remember(cfg ReloConfig, e datastore.Entry, target, source string) error {
+	fi, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	meta := make(map[string][]byte)
+	for k, v := range e.Data {
+		meta[k] = v
+	}
+	for k, v := range fileMeta(fi) {
+		meta[k] = v
+	}
+	meta[MetaDateSource] = []byte(source)
+	return cfg.Datastore.Add(cfg.FingerPrintCol, e.FingerPrint, target, meta)
+}
+
+// inTree reports whether name is dir or inside it, comparing absolute paths
+func inTree(name, dir string) bool {
+	if abs, err := filepath.Abs(name); err == nil {
+		name = abs
+	}
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	rel, err := filepath.Rel(dir, name)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// reloVars collects the layout variables of an image for the templates it may be laid out with.
+// Only what the templates use is read, so files the image decoders do not understand can still
+// be relocated by their EXIF data. An entry already fingerprinted with cfg.Algorithm provides the
+// dimensions and fingerprint.
+func reloVars(cfg ReloConfig, path string, e *datastore.Entry, tmpls ...*layout.Template) (layout.Vars, error) {
+	uses := func(names ...string) bool {
+		for _, t := range tmpls {
+			if t.Uses(names...) {
+				return true
+			}
+		}
+		return false
+	}
+
+	base := filepath.Base(path)
+	ext := filepath.Ext(base)
+	vars := layout.Vars{
+		Name: strings.TrimSuffix(base, ext),
+		Ext:  strings.ToLower(strings.TrimPrefix(ext, ".")),
+	}
+
+	if uses(layout.VarRandom) {
+		id, err := uuid()
+		if err != nil {
+			return vars, err
+		}
+		vars.Random = id
+	}
+	if uses(layout.VarHash) {
+		sum, err := fs.ContentHash(path)
+		if err != nil {
+			return vars, err
+		}
+		vars.Hash = sum
+	}
+
+	dt, source, err := img.DateTaken(path, cfg.DateSources)
+	if err != nil {
+		return vars, err
+	}
+	vars.Taken, vars.DateSource = dt, source
+
+	if uses(layout.VarCameraMake, layout.VarCameraModel, layout.VarLens) {
+		// images without EXIF data expand the camera to unknown
+		if c, err := img.ExifCamera(path); err == nil {
+			vars.CameraMake, vars.CameraModel, vars.Lens = c.Make, c.Model, c.Lens
+		}
+	}
+
+	if e != nil {
+		vars.Width = int(datastore.Uint64Value(e.Data["width"]))
+		vars.Height = int(datastore.Uint64Value(e.Data["height"]))
+		vars.FingerPrint = e.FingerPrint
+	} else if uses(layout.VarWidth, layout.VarHeight, layout.VarFingerPrint) {
+		i, err := img.NewImage(path)
+		if err != nil {
+			return vars, err
+		}
+		vars.Width, vars.Height = int(i.Width()), int(i.Height())
+
+		if uses(layout.VarFingerPrint) {
+			fper, err := img.NewFingerPrinter(cfg.Algorithm, i)
+			if err != nil {
+				return vars, err
+			}
+			if vars.FingerPrint, err = fper.FingerPrint(); err != nil {
+				return vars, err
+			}
+		}
+	}
+	return vars, nil
+}
+
+// reloTarget expands the layout of an image under dir. A target that is free, neither on disk
+// nor planned for another image, is returned as it is. A target that holds the same content as
+// the image is returned with done set, as the image was relocated there before. Otherwise a
+// template with {counter} or {suffix} counts up from 1 until one of the two happens; without one
+// the target is an error.
+func reloTarget(dir string, tmpl *layout.Template, vars layout.Vars, path string, planned map[string]string) (string, bool, error) {
+	var sum []byte
+	same := func(other string) bool {
+		if sum == nil {
+			var err error
+			if sum, err = fs.ContentHash(path); err != nil {
+				return false
+			}
+		}
+		got, err := fs.ContentHash(other)
+		return err == nil && bytes.Equal(got, sum)
+	}
+
+	for counter := 1; ; counter++ {
+		rel, err := tmpl.Expand(vars, counter)
+		if err != nil {
+			return "", false, err
+		}
+		target := filepath.Join(dir, rel)
+
+		other, found := planned[target]
+		if !found {
+			if _, err := os.Lstat(target); os.IsNotExist(err) {
+				return target, false, nil
+			}
+			other = target
+		}
+		if same(other) {
+			return target, true, nil
+		}
+		if !tmpl.Uses(layout.VarCounter, layout.VarSuffix) {
+			return "", false, fmt.Errorf("target already exists: %s", target)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/marklap/imgdupdetect/datastore"
+	"github.com/marklap/imgdupdetect/img"
+	"github.com/marklap/imgdupdetect/index"
+)
+
+// tstRelocate copies the images of from to to, handling duplicates as dupes says
+func tstRelocate(ds *datastore.Datastore, from, to, dupes string) error {
+	return ReloRun(ReloConfig{
+		From:           from,
+		To:             to,
+		Mode:           ModeCopy,
+		Algorithm:      img.AlgoSHA256,
+		Dupes:          dupes,
+		Datastore:      ds,
+		FingerPrintCol: tstFingerPrintCol,
+		Sniff:          true,
+	})
+}
+
+// tree returns the files under dir relative to it, with the date folders of the default layout
+// left out
+func tree(t *testing.T, dir string) []string {
+	var res []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if parts := strings.Split(filepath.ToSlash(rel), "/"); parts[0] != "duplicates" {
+			rel = parts[len(parts)-1]
+		} else {
+			rel = "duplicates/" + parts[len(parts)-1]
+		}
+		res = append(res, rel[:strings.Index(rel, ".")])
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// tstArchive creates an archive with one image relocated into it and a directory of images to
+// import: an exact copy of the archived image, another image, and a file the decoders cannot read
+func tstArchive(t *testing.T, dir string, ds *datastore.Datastore) (string, string) {
+	archived, src, dst := filepath.Join(dir, "archived"), filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	for _, d := range []string{archived, src, dst} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writePNG(t, filepath.Join(archived, "a.png"), 32, 32, hGradient)
+	if err := tstRelocate(ds, archived, dst, DupesRoute); err != nil {
+		t.Fatal(err)
+	}
+
+	writePNG(t, filepath.Join(src, "copy.png"), 32, 32, hGradient)
+	writePNG(t, filepath.Join(src, "other.png"), 32, 32, vGradient)
+	if err := os.WriteFile(filepath.Join(src, "broken.jpg"), []byte("\xff\xd8\xff\xe0 not really a jpeg"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return src, dst
+}
+
+func TestRelocateDupes(t *testing.T) {
+	for _, tst := range []struct {
+		dupes string
+		want  []string
+	}{
+		{DupesOff, []string{"a", "broken", "copy", "other"}},
+		{DupesSkip, []string{"a", "broken", "other"}},
+		{DupesRoute, []string{"a", "broken", "duplicates/copy", "other"}},
+	} {
+		dir, ds := tstDir(t)
+		src, dst := tstArchive(t, dir, ds)
+
+		if err := tstRelocate(ds, src, dst, tst.dupes); err != nil {
+			t.Errorf("%s: %s", tst.dupes, err)
+		}
+		if got := tree(t, dst); strings.Join(got, " ") != strings.Join(tst.want, " ") {
+			t.Errorf("%s: relocated files mismatch - want: %s, got: %s", tst.dupes, tst.want, got)
+		}
+
+		ds.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestReloDuplicate(t *testing.T) {
+	dir, ds := tstDir(t)
+	defer os.RemoveAll(dir)
+	defer ds.Close()
+	src, dst := tstArchive(t, dir, ds)
+
+	cfg := ReloConfig{To: dst, Datastore: ds, FingerPrintCol: tstFingerPrintCol, Threshold: 0}
+	ix, err := index.Open(ds, tstFingerPrintCol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fpCfg := DupeDetectConfig{Algorithm: img.AlgoSHA256}
+
+	copied, err := fingerPrintFile(fpCfg, filepath.Join(src, "copy.png"), newBudget(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := reloDuplicate(cfg, ix, nil, copied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == nil || !d.exact || filepath.Base(filepath.Dir(filepath.Dir(d.existing))) != "dst" {
+		t.Errorf("duplicate of an archived image mismatch - got: %+v", d)
+	}
+
+	// an image imported earlier in the same run counts too
+	other, err := fingerPrintFile(fpCfg, filepath.Join(src, "other.png"), newBudget(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, err := reloDuplicate(cfg, ix, nil, other); err != nil || d != nil {
+		t.Errorf("duplicate of a new image - want: none, got: %+v (%v)", d, err)
+	}
+	imported := []reloImport{{source: other.Name, target: filepath.Join(dst, "other.png"), fp: other.FingerPrint}}
+	again := other
+	again.Name = filepath.Join(src, "again.png")
+	if err := os.Link(other.Name, again.Name); err != nil {
+		t.Fatal(err)
+	}
+	d, err = reloDuplicate(cfg, ix, imported, again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == nil || !d.exact || d.existing != imported[0].target {
+		t.Errorf("duplicate of an imported image mismatch - got: %+v", d)
+	}
+}
+
+func TestRelocateRerun(t *testing.T) {
+	dir, ds := tstDir(t)
+	defer os.RemoveAll(dir)
+	defer ds.Close()
+	src, dst := tstArchive(t, dir, ds)
+
+	if err := tstRelocate(ds, src, dst, DupesRoute); err != nil {
+		t.Fatal(err)
+	}
+	want := tree(t, dst)
+	if err := tstRelocate(ds, src, dst, DupesRoute); err != nil {
+		t.Fatal(err)
+	}
+	if got := tree(t, dst); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("files after a second run mismatch - want: %s, got: %s", want, got)
+	}
+}
+
+func TestRelocateUndated(t *testing.T) {
+	dir, ds := tstDir(t)
+	defer os.RemoveAll(dir)
+	defer ds.Close()
+
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	for _, d := range []string{src, dst} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writePNG(t, filepath.Join(src, "a.png"), 32, 32, hGradient)
+
+	// the layout has no {hash}, but the undated layout it falls back to does
+	err := ReloRun(ReloConfig{
+		From:        src,
+		To:          dst,
+		Mode:        ModeCopy,
+		Layout:      "{year}/{month}/{camera_model}/{date}_{counter}.{ext}",
+		Algorithm:   img.AlgoSHA256,
+		DateSources: []string{img.DateExifOriginal},
+		Sniff:       true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(filepath.Join(dst, "undated"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || strings.Contains(entries[0].Name(), "unknown") {
+		t.Errorf("undated files mismatch - want: a.<hash>.png, got: %v", entries)
+	}
+}
+
+func TestRelocateFallback(t *testing.T) {
+	dir, ds := tstDir(t)
+	defer os.RemoveAll(dir)
+	defer ds.Close()
+
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	for _, d := range []string{src, dst} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writePNG(t, filepath.Join(src, "party_20190704.png"), 32, 32, hGradient)
+	writePNG(t, filepath.Join(src, "scan.png"), 32, 32, vGradient)
+
+	// neither image has exif data, so only the one named after its date is dated
+	err := ReloRun(ReloConfig{
+		From:           src,
+		To:             dst,
+		Mode:           ModeCopy,
+		Algorithm:      img.AlgoSHA256,
+		DateSources:    []string{img.DateExifOriginal, img.DateFileName},
+		Dupes:          DupesRoute,
+		Datastore:      ds,
+		FingerPrintCol: tstFingerPrintCol,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	folders, sources := make(map[string]string), make(map[string]string)
+	err = filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dst, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(rel)
+		name = name[:strings.Index(name, ".")]
+		folders[name] = strings.Split(filepath.ToSlash(rel), "/")[0]
+		rec, err := ds.GetPath(tstFingerPrintCol, path)
+		if err != nil || rec == nil {
+			return fmt.Errorf("%s not in the collection (%v)", path, err)
+		}
+		col, err := ds.Get(tstFingerPrintCol, rec.FingerPrint)
+		if err != nil {
+			return err
+		}
+		sources[name] = string(col[path][MetaDateSource])
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(folders) != 2 || folders["scan"] != "undated" || !strings.HasPrefix(folders["party_20190704"], "2019") {
+		t.Errorf("relocated folders mismatch - want: party_20190704 in 2019, scan in undated, got: %v", folders)
+	}
+	if sources["party_20190704"] != img.DateFileName || sources["scan"] != "" {
+		t.Errorf("recorded date sources mismatch - want: party_20190704 from %s, scan from none, got: %v", img.DateFileName, sources)
+	}
+}
+
+func TestRelocateNested(t *testing.T) {
+	dir, err := os.MkdirTemp("", "imgdd-cli-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src, sub := filepath.Join(dir, "src"), filepath.Join(dir, "src", "sorted")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(wd, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tst := range []struct {
+		from, to string
+	}{
+		{src, src},
+		{src, rel},
+		{src, sub},
+		{sub, src},
+		{src, sub + string(filepath.Separator)},
+	} {
+		fset := flag.NewFlagSet("relocate", flag.ContinueOnError)
+		run := relocateCommand(fset)
+		if err := fset.Parse([]string{"-from", tst.from, "-to", tst.to}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := run(nil); err == nil {
+			t.Errorf("relocate from %s to %s - want: error, got: nil", tst.from, tst.to)
+		} else if _, ok := err.(usageError); !ok {
+			t.Errorf("relocate from %s to %s - want: usage error, got: %s", tst.from, tst.to, err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package cli
+
+import (
+	"io"
+	"os"
+
+	"github.com/marklap/imgdupdetect/datastore"
+	"github.com/marklap/imgdupdetect/img"
+	"github.com/marklap/imgdupdetect/index"
+	"github.com/marklap/imgdupdetect/keeper"
+	"github.com/marklap/imgdupdetect/report"
+	"github.com/marklap/imgdupdetect/stats"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FormatText is the report format that logs the duplicates like a scan does
+const FormatText = "text"
+
+// contentAlgorithm is the algorithm reported for the groups of the content collection
+const contentAlgorithm = "content"
+
+// ReportConfig is the report CLI config
+type ReportConfig struct {
+
+	// Datastore is the datastore
+	Datastore *datastore.Datastore
+	// FingerPrintCol is the name of the collection to use for fingerprints
+	FingerPrintCol string
+	// Algorithm is the name of the fingerprint algorithm the collection was built with
+	Algorithm string
+	// Threshold is the number of differing fingerprint bits still considered a duplicate
+	Threshold int
+	// ContentCol is the name of the collection of file content hashes; empty leaves exact copies
+	// out of the report
+	ContentCol string
+	// Format is FormatText, report.FormatHTML or one of report.Formats
+	Format string
+	// Out is where the report is written to; text reports are logged instead
+	Out io.Writer
+	// File is the file the report is written to instead of Out. It is only created once the
+	// report is built, so a report that fails leaves no file behind.
+	File string
+	// Dir is the directory an html report is written to
+	Dir string
+	// Keep selects the file of each group worth keeping; empty uses keeper.Default
+	Keep keeper.Chain
+}
+
+// ReportRun reports the duplicates already in the datastore without scanning any files. It
+// returns the number of duplicates found.
+func ReportRun(cfg ReportConfig) (int, error) {
+	if _, err := img.NewFingerPrinter(cfg.Algorithm, nil); err != nil {
+		return 0, err
+	}
+
+	ix, err := index.Open(cfg.Datastore, cfg.FingerPrintCol)
+	if err != nil {
+		return 0, err
+	}
+
+	if cfg.Format == FormatText {
+		dcfg := DupeDetectConfig{
+			Datastore:      cfg.Datastore,
+			FingerPrintCol: cfg.FingerPrintCol,
+			Algorithm:      cfg.Algorithm,
+			Threshold:      cfg.Threshold,
+			ContentCol:     cfg.ContentCol,
+			Keep:           cfg.Keep,
+		}
+		scanStats := stats.NewScanStats()
+		if cfg.ContentCol != "" {
+			if _, err := exactCopies(dcfg, nil, scanStats); err != nil {
+				return 0, err
+			}
+		}
+		if err := reportDuplicates(dcfg, ix, scanStats); err != nil {
+			return 0, err
+		}
+		log.Infof("%d duplicates found", scanStats.DuplicatesFound)
+		return int(scanStats.DuplicatesFound), nil
+	}
+
+	var groups []report.Group
+	if cfg.ContentCol != "" {
+		groups, err = report.Build(cfg.Datastore, cfg.ContentCol, contentAlgorithm, 0, nil, cfg.Keep)
+		if err != nil {
+			return 0, err
+		}
+	}
+	found, err := report.Build(cfg.Datastore, cfg.FingerPrintCol, cfg.Algorithm, cfg.Threshold, ix, cfg.Keep)
+	if err != nil {
+		return 0, err
+	}
+	groups = append(groups, found...)
+
+	var n int
+	for _, g := range groups {
+		n += len(g.Images) - 1 // we don't count the original
+	}
+	if cfg.Format == report.FormatHTML {
+		return n, report.WriteHTML(cfg.Dir, groups)
+	}
+	if cfg.File == "" {
+		return n, report.Write(cfg.Out, cfg.Format, groups)
+	}
+
+	fd, err := os.Create(cfg.File)
+	if err != nil {
+		return 0, err
+	}
+	if err := report.Write(fd, cfg.Format, groups); err != nil {
+		fd.Close()
+		return 0, err
+	}
+	return n, fd.Close()
+}
+
+// validFormat reports whether format is a known report format
+func validFormat(format string) bool {
+	if format == FormatText || format == report.FormatHTML {
+		return true
+	}
+	for _, f := range report.Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
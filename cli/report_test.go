@@ -0,0 +1,49 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/marklap/imgdupdetect/img"
+	"github.com/marklap/imgdupdetect/report"
+)
+
+func TestReportFile(t *testing.T) {
+	dir, ds := tstDir(t)
+	defer os.RemoveAll(dir)
+	defer ds.Close()
+
+	kept, dup := filepath.Join(dir, "kept.jpg"), filepath.Join(dir, "dup.jpg")
+	fp := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	tstStore(t, ds, tstFingerPrintCol, fp, kept, "kept", 200, 100)
+	tstStore(t, ds, tstFingerPrintCol, fp, dup, "dup", 100, 100)
+
+	cfg := ReportConfig{
+		Datastore:      ds,
+		FingerPrintCol: tstFingerPrintCol,
+		Algorithm:      "unknown",
+		Format:         report.FormatCSV,
+		File:           filepath.Join(dir, "report.csv"),
+	}
+	if _, err := ReportRun(cfg); err == nil {
+		t.Errorf("report with an unknown algorithm - want: error, got: nil")
+	}
+	if exists(cfg.File) {
+		t.Errorf("failed report left %s behind", cfg.File)
+	}
+
+	cfg.Algorithm = img.AlgoSHA256
+	n, err := ReportRun(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(cfg.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || !strings.Contains(string(got), dup) {
+		t.Errorf("report mismatch - want: 1 duplicate, %s, got: %d, %s", dup, n, got)
+	}
+}
@@ -0,0 +1,316 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/marklap/imgdupdetect/datastore"
+	"github.com/marklap/imgdupdetect/fs"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ActionUndo is the journal action of an entry that reverses another
+const ActionUndo = "undo"
+
+// UndoConfig is the undo CLI config
+type UndoConfig struct {
+
+	// Datastore is the datastore
+	Datastore *datastore.Datastore
+	// Cols are the collections restored files are removed from, so the next scan picks them up
+	Cols []string
+	// Run is the journal run to undo; empty undoes the last run that has entries left to undo
+	Run string
+	// Seqs limits the undo to these journal entries of the run; empty undoes the whole run
+	Seqs []uint64
+	// DryRun reports what would be restored without touching any file
+	DryRun bool
+}
+
+// UndoSummary counts what an undo restored
+type UndoSummary struct {
+	Restored int
+	Failed   int
+}
+
+// UndoRun reverses the journaled actions of a run, newest first. Nothing is overwritten unless
+// the content hashes show it is what the journal expects; entries that fail the checks are left
+// alone and counted as failed.
+func UndoRun(cfg UndoConfig) (UndoSummary, error) {
+	var sum UndoSummary
+
+	journal, err := cfg.Datastore.Journal()
+	if err != nil {
+		return sum, err
+	}
+
+	undone := make(map[uint64]bool)
+	for _, e := range journal {
+		if e.Action == ActionUndo {
+			undone[e.Undoes] = true
+		}
+	}
+	run := cfg.Run
+	if run == "" {
+		for _, e := range journal {
+			if e.Action != ActionUndo && !e.Aborted && !undone[e.Seq] {
+				run = e.Run
+			}
+		}
+	}
+	if run == "" {
+		return sum, fmt.Errorf("the journal has nothing left to undo")
+	}
+
+	selected := make(map[uint64]bool)
+	for _, seq := range cfg.Seqs {
+		selected[seq] = true
+	}
+
+	var todo []datastore.JournalEntry
+	for _, e := range journal {
+		if e.Run != run || e.Action == ActionUndo {
+			continue
+		}
+		if len(selected) > 0 && !selected[e.Seq] {
+			continue
+		}
+		delete(selected, e.Seq)
+		if undone[e.Seq] {
+			log.Debugf("entry %d was undone already: %s", e.Seq, e.Path)
+			continue
+		}
+		if e.Aborted {
+			log.Debugf("entry %d was never applied: %s", e.Seq, e.Path)
+			continue
+		}
+		todo = append(todo, e)
+	}
+	for seq := range selected {
+		// the entries found were taken out of the set, so whatever is left does not exist
+		return sum, fmt.Errorf("no entry %d in run %s", seq, run)
+	}
+	sort.Slice(todo, func(a, b int) bool {
+		return todo[a].Seq > todo[b].Seq
+	})
+
+	verb := "restored"
+	if cfg.DryRun {
+		verb = "would restore"
+	}
+
+	undoRun := runID()
+	for _, e := range todo {
+		// apply stopped between journaling the action and completing the entry
+		if e.Pending && !applied(e) {
+			log.Infof("entry %d was never applied: %s", e.Seq, e.Path)
+			if !cfg.DryRun {
+				if err := cfg.Datastore.AbortJournal(e.Seq); err != nil {
+					return sum, err
+				}
+			}
+			continue
+		}
+		if err := checkUndo(e); err != nil {
+			log.Errorf("cannot undo entry %d: %s", e.Seq, err)
+			sum.Failed++
+			continue
+		}
+		if cfg.DryRun {
+			log.Infof("%s %s (%s)", verb, e.Path, e.Action)
+			sum.Restored++
+			continue
+		}
+
+		if err := undo(e); err != nil {
+			log.Errorf("cannot undo entry %d: %s", e.Seq, err)
+			sum.Failed++
+			continue
+		}
+		if err := forget(cfg.Datastore, cfg.Cols, e.Path); err != nil {
+			return sum, err
+		}
+		_, err := cfg.Datastore.AppendJournal(datastore.JournalEntry{
+			Run:    undoRun,
+			Time:   time.Now(),
+			Action: ActionUndo,
+			Path:   e.Path,
+			Dest:   e.Dest,
+			Keeper: e.Keeper,
+			Hash:   e.Hash,
+			Undoes: e.Seq,
+		})
+		if err != nil {
+			return sum, err
+		}
+		log.Infof("%s %s (%s)", verb, e.Path, e.Action)
+		sum.Restored++
+	}
+
+	log.Infof("%s %d files of run %s; %d failed", verb, sum.Restored, run, sum.Failed)
+	return sum, nil
+}
+
+// applied reports whether the action of a pending entry was taken: the file is no longer at its
+// path with the content it had, or it is a link to its keeper now
+func applied(e datastore.JournalEntry) bool {
+	fi, err := os.Stat(e.Path)
+	if err != nil || checkHash(e.Path, e.Hash) != nil {
+		return true
+	}
+	if e.Action == ActionHardlink || e.Action == ActionSymlink {
+		kfi, err := os.Stat(e.Keeper)
+		return err == nil && os.SameFile(fi, kfi)
+	}
+	return false
+}
+
+// checkUndo verifies that an entry can be undone without losing anything
+func checkUndo(e datastore.JournalEntry) error {
+	switch e.Action {
+	case ActionQuarantine:
+		if _, err := os.Lstat(e.Path); err == nil {
+			return fmt.Errorf("%s exists again", e.Path)
+		}
+		return checkHash(e.Dest, e.Hash)
+	case ActionDelete:
+		if _, err := os.Lstat(e.Path); err == nil {
+			return fmt.Errorf("%s exists again", e.Path)
+		}
+		return checkHash(source(e), e.Hash)
+	case ActionHardlink, ActionSymlink:
+		fi, err := os.Stat(e.Path)
+		if err != nil {
+			return err
+		}
+		kfi, err := os.Stat(e.Keeper)
+		if err != nil {
+			return err
+		}
+		if !os.SameFile(fi, kfi) {
+			return fmt.Errorf("%s is no longer a link to %s", e.Path, e.Keeper)
+		}
+		return checkHash(source(e), e.Hash)
+	}
+	return fmt.Errorf("unknown action: %s", e.Action)
+}
+
+// checkHash verifies that a file has the content hash the journal recorded
+func checkHash(path string, want []byte) error {
+	got, err := fs.ContentHash(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("content of %s does not match the journal", path)
+	}
+	return nil
+}
+
+// source returns the file a deleted or linked duplicate is restored from: its stashed copy, or
+// the keeper when the two were byte-identical
+func source(e datastore.JournalEntry) string {
+	if e.Dest != "" {
+		return e.Dest
+	}
+	return e.Keeper
+}
+
+// undo reverses an entry that passed checkUndo
+func undo(e datastore.JournalEntry) error {
+	switch e.Action {
+	case ActionQuarantine:
+		return fs.Move(e.Dest, e.Path)
+	case ActionDelete:
+		if e.Dest != "" {
+			return fs.Move(e.Dest, e.Path)
+		}
+		return fs.Copy(e.Keeper, e.Path)
+	case ActionHardlink, ActionSymlink:
+		// restore next to the link first, so the link is only replaced by a complete file
+		tmp := filepath.Join(filepath.Dir(e.Path), "."+filepath.Base(e.Path)+".imgdd-undo")
+		os.Remove(tmp)
+		var err error
+		if e.Dest != "" {
+			err = fs.Move(e.Dest, tmp)
+		} else {
+			err = fs.Copy(e.Keeper, tmp)
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, e.Path); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown action: %s", e.Action)
+}
+
+// ListJournal writes the runs of the journal with their number of entries and how many were
+// undone, or the entries of one run when run is set
+func ListJournal(w io.Writer, ds *datastore.Datastore, run string) error {
+	journal, err := ds.Journal()
+	if err != nil {
+		return err
+	}
+
+	undone := make(map[uint64]bool)
+	for _, e := range journal {
+		if e.Action == ActionUndo {
+			undone[e.Undoes] = true
+		}
+	}
+
+	type runInfo struct {
+		name    string
+		entries int
+		undone  int
+	}
+	var runs []*runInfo
+	byName := make(map[string]*runInfo)
+	for _, e := range journal {
+		if e.Action == ActionUndo {
+			continue
+		}
+		if run != "" {
+			if e.Run == run {
+				state := ""
+				if undone[e.Seq] {
+					state = " (undone)"
+				} else if e.Aborted {
+					state = " (aborted)"
+				} else if e.Pending {
+					state = " (pending)"
+				}
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s%s\n", e.Seq, e.Time.Format("2006-01-02 15:04:05"), e.Action, e.Path, state)
+			}
+			continue
+		}
+		if e.Aborted {
+			continue
+		}
+		r, found := byName[e.Run]
+		if !found {
+			r = &runInfo{name: e.Run}
+			byName[e.Run] = r
+			runs = append(runs, r)
+		}
+		r.entries++
+		if undone[e.Seq] {
+			r.undone++
+		}
+	}
+
+	for _, r := range runs {
+		fmt.Fprintf(w, "%s\t%d entries\t%d undone\n", r.name, r.entries, r.undone)
+	}
+	return nil
+}
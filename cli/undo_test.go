@@ -0,0 +1,181 @@
+package cli
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marklap/imgdupdetect/datastore"
+	"github.com/marklap/imgdupdetect/fs"
+)
+
+// tstUndo undoes a run, or the last one with entries left when run is empty
+func tstUndo(t *testing.T, ds *datastore.Datastore, run string) UndoSummary {
+	sum, err := UndoRun(UndoConfig{
+		Datastore: ds,
+		Cols:      []string{tstFingerPrintCol},
+		Run:       run,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sum
+}
+
+func TestUndo(t *testing.T) {
+	for _, tst := range []struct {
+		action string
+		// dup is the content of the duplicate; the same as the keeper's is restored from the keeper
+		dup string
+	}{
+		{ActionDelete, "kept"},
+		{ActionDelete, "dup"},
+		{ActionQuarantine, "dup"},
+		{ActionHardlink, "kept"},
+		{ActionHardlink, "dup"},
+		{ActionSymlink, "dup"},
+	} {
+		dir, ds := tstDir(t)
+
+		kept, dup := filepath.Join(dir, "kept.jpg"), filepath.Join(dir, "dup.jpg")
+		fp := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+		tstStore(t, ds, tstFingerPrintCol, fp, kept, "kept", 200, 100)
+		tstStore(t, ds, tstFingerPrintCol, fp, dup, tst.dup, 100, 100)
+
+		applied := tstApply(t, ds, dir, tst.action, 0)
+		sum := tstUndo(t, ds, "")
+		if sum.Restored != 1 || sum.Failed != 0 {
+			t.Errorf("%s of %s: summary mismatch - want: 1 restored, got: %+v", tst.action, tst.dup, sum)
+		}
+
+		fi, err := os.Lstat(dup)
+		if err != nil {
+			t.Fatalf("%s of %s: not restored: %s", tst.action, tst.dup, err)
+		}
+		if !fi.Mode().IsRegular() {
+			t.Errorf("%s of %s: restored file is not a regular file: %s", tst.action, tst.dup, fi.Mode())
+		}
+		if kfi, _ := os.Stat(kept); os.SameFile(fi, kfi) {
+			t.Errorf("%s of %s: restored file is still the keeper", tst.action, tst.dup)
+		}
+		if got, err := os.ReadFile(dup); err != nil || string(got) != tst.dup {
+			t.Errorf("%s of %s: restored content mismatch - got: %s (%v)", tst.action, tst.dup, got, err)
+		}
+		if got, err := os.ReadFile(kept); err != nil || string(got) != "kept" {
+			t.Errorf("%s of %s: keeper changed - got: %s (%v)", tst.action, tst.dup, got, err)
+		}
+
+		// the run is fully undone, so there is nothing left for an undo without a run
+		if _, err := UndoRun(UndoConfig{Datastore: ds}); err == nil {
+			t.Errorf("%s of %s: second undo - want: error, got: nil", tst.action, tst.dup)
+		}
+		if sum := tstUndo(t, ds, applied.Run); sum.Restored != 0 {
+			t.Errorf("%s of %s: undone twice - got: %+v", tst.action, tst.dup, sum)
+		}
+
+		ds.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestUndoRefuses(t *testing.T) {
+	dir, ds := tstDir(t)
+	defer os.RemoveAll(dir)
+	defer ds.Close()
+
+	kept, dup := filepath.Join(dir, "kept.jpg"), filepath.Join(dir, "dup.jpg")
+	fp := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	tstStore(t, ds, tstFingerPrintCol, fp, kept, "kept", 200, 100)
+	tstStore(t, ds, tstFingerPrintCol, fp, dup, "kept", 100, 100)
+	tstApply(t, ds, dir, ActionDelete, 0)
+
+	// the keeper the duplicate is restored from no longer has the content it had
+	if err := os.WriteFile(kept, []byte("edited"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sum := tstUndo(t, ds, "")
+	if sum.Restored != 0 || sum.Failed != 1 {
+		t.Errorf("summary mismatch - want: 1 failed, got: %+v", sum)
+	}
+	if exists(dup) {
+		t.Errorf("duplicate restored from a changed keeper")
+	}
+}
+
+func TestUndoLastRun(t *testing.T) {
+	dir, ds := tstDir(t)
+	defer os.RemoveAll(dir)
+	defer ds.Close()
+
+	fp := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	a, b := filepath.Join(dir, "a.jpg"), filepath.Join(dir, "b.jpg")
+	tstStore(t, ds, tstFingerPrintCol, fp, filepath.Join(dir, "kept.jpg"), "kept", 200, 100)
+	tstStore(t, ds, tstFingerPrintCol, fp, a, "a", 100, 100)
+	first := tstApply(t, ds, dir, ActionDelete, 0)
+	time.Sleep(time.Millisecond)
+	tstStore(t, ds, tstFingerPrintCol, fp, b, "b", 100, 100)
+	second := tstApply(t, ds, dir, ActionDelete, 0)
+	if first.Run == second.Run {
+		t.Fatalf("runs share an identifier: %s", first.Run)
+	}
+
+	// the newest run is undone first, then the one before it
+	if sum := tstUndo(t, ds, ""); sum.Restored != 1 || !exists(b) || exists(a) {
+		t.Errorf("first undo mismatch - want: b restored, got: %+v", sum)
+	}
+	if sum := tstUndo(t, ds, ""); sum.Restored != 1 || !exists(a) {
+		t.Errorf("second undo mismatch - want: a restored, got: %+v", sum)
+	}
+
+	var out bytes.Buffer
+	if err := ListJournal(&out, ds, ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, run := range []string{first.Run, second.Run} {
+		if !strings.Contains(out.String(), run+"\t1 entries\t1 undone") {
+			t.Errorf("journal listing misses run %s - got: %s", run, out.String())
+		}
+	}
+}
+
+func TestUndoPending(t *testing.T) {
+	dir, ds := tstDir(t)
+	defer os.RemoveAll(dir)
+	defer ds.Close()
+
+	kept, dup := filepath.Join(dir, "kept.jpg"), filepath.Join(dir, "dup.jpg")
+	for _, path := range []string{kept, dup} {
+		if err := os.WriteFile(path, []byte("kept"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash, err := fs.ContentHash(dup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// apply stopped after journaling a delete it did not get to take, and after one it took
+	e := datastore.JournalEntry{Run: runID(), Time: time.Now(), Action: ActionDelete, Path: dup, Keeper: kept, Hash: hash, Pending: true}
+	if _, err := ds.AppendJournal(e); err != nil {
+		t.Fatal(err)
+	}
+	if sum := tstUndo(t, ds, ""); sum.Restored != 0 || sum.Failed != 0 {
+		t.Errorf("undo of an action never taken - want: nothing, got: %+v", sum)
+	}
+	if got, _ := ds.Journal(); len(got) != 1 || !got[0].Aborted {
+		t.Errorf("entry of an action never taken not aborted - got: %+v", got)
+	}
+
+	if _, err := ds.AppendJournal(e); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(dup); err != nil {
+		t.Fatal(err)
+	}
+	if sum := tstUndo(t, ds, ""); sum.Restored != 1 || !exists(dup) {
+		t.Errorf("undo of a pending action that was taken - want: 1 restored, got: %+v", sum)
+	}
+}
@@ -2,6 +2,8 @@ package datastore
 
 import (
 	"fmt"
+	"path/filepath"
+	"strings"
 
 	"github.com/boltdb/bolt"
 	log "github.com/sirupsen/logrus"
@@ -34,10 +36,22 @@ type Datastorer interface {
 	Remove(collection string, fingerprint []byte, filename string) error
 }
 
+// Indexer maintains a secondary index over the fingerprints of a collection. It is called
+// within the transaction that creates or deletes a fingerprint, so the index is stored
+// atomically with the collection.
+type Indexer interface {
+	// Insert adds a fingerprint that is new to the collection.
+	Insert(tx *bolt.Tx, fingerprint []byte) error
+
+	// Delete removes a fingerprint that no longer has any files in the collection.
+	Delete(tx *bolt.Tx, fingerprint []byte) error
+}
+
 // Datastore is the default implementation of a Datastorer.
 type Datastore struct {
-	Cfg Config
-	db  *bolt.DB
+	Cfg      Config
+	db       *bolt.DB
+	indexers map[string][]Indexer
 }
 
 // Open opens the default datastore and preps it for transactions.
@@ -48,11 +62,27 @@ func Open(cfg Config) (*Datastore, error) {
 	}
 
 	return &Datastore{
-		Cfg: cfg,
-		db:  db,
+		Cfg:      cfg,
+		db:       db,
+		indexers: make(map[string][]Indexer),
 	}, nil
 }
 
+// AddIndexer registers an Indexer to be kept up to date with the fingerprints of a collection.
+func (d *Datastore) AddIndexer(col string, ix Indexer) {
+	d.indexers[col] = append(d.indexers[col], ix)
+}
+
+// View runs fn within a read-only transaction.
+func (d *Datastore) View(fn func(*bolt.Tx) error) error {
+	return d.db.View(fn)
+}
+
+// Update runs fn within a read-write transaction.
+func (d *Datastore) Update(fn func(*bolt.Tx) error) error {
+	return d.db.Update(fn)
+}
+
 // Close closes the default datastore.
 func (d *Datastore) Close() error {
 	return d.db.Close()
@@ -80,7 +110,7 @@ func (d *Datastore) Get(col string, fp []byte) (map[string]map[string][]byte, er
 					log.Errorf(errTmplBucketNotFound, k)
 				}
 				fileBkt.ForEach(func(mKey, mVal []byte) error {
-					res[string(k)][string(mKey)] = mVal
+					res[string(k)][string(mKey)] = append([]byte(nil), mVal...)
 					return nil
 				})
 			}
@@ -91,55 +121,282 @@ func (d *Datastore) Get(col string, fp []byte) (map[string]map[string][]byte, er
 	return res, err
 }
 
+// Entry is the file data of one file and its fingerprint.
+type Entry struct {
+	FingerPrint []byte
+	Name        string
+	Data        map[string][]byte
+}
+
 // Add adds file data to the set of file data associated with this fingerprint.
 func (d *Datastore) Add(col string, fp []byte, name string, data map[string][]byte) error {
-	var err error
-	err = d.db.Update(func(tx *bolt.Tx) error {
-		cBkt, err := tx.CreateBucketIfNotExists([]byte(col))
-		if err != nil {
-			return err
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return d.add(tx, col, fp, name, data)
+	})
+}
+
+// AddBatch adds the file data of many files within a single transaction.
+func (d *Datastore) AddBatch(col string, entries []Entry) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		for _, e := range entries {
+			if err := d.add(tx, col, e.FingerPrint, e.Name, e.Data); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+}
 
-		fpBkt, err := cBkt.CreateBucketIfNotExists(fp)
-		if err != nil {
+// add adds file data to a fingerprint within a transaction.
+func (d *Datastore) add(tx *bolt.Tx, col string, fp []byte, name string, data map[string][]byte) error {
+	cBkt, err := tx.CreateBucketIfNotExists([]byte(col))
+	if err != nil {
+		return err
+	}
+
+	isNew := cBkt.Bucket(fp) == nil
+	fpBkt, err := cBkt.CreateBucketIfNotExists(fp)
+	if err != nil {
+		return err
+	}
+
+	if isNew {
+		if err := bumpGeneration(tx, col); err != nil {
 			return err
 		}
+		for _, ix := range d.indexers[col] {
+			if err := ix.Insert(tx, fp); err != nil {
+				return err
+			}
+		}
+	}
 
-		fileBkt, err := fpBkt.CreateBucketIfNotExists([]byte(name))
-		if err != nil {
+	// the data of a file added again replaces what was stored, so no key outlives its value
+	if fpBkt.Bucket([]byte(name)) != nil {
+		if err := fpBkt.DeleteBucket([]byte(name)); err != nil {
 			return err
 		}
+	}
+	fileBkt, err := fpBkt.CreateBucket([]byte(name))
+	if err != nil {
+		return err
+	}
 
-		for k, v := range data {
-			fileBkt.Put([]byte(k), v)
+	for k, v := range data {
+		if err := fileBkt.Put([]byte(k), v); err != nil {
+			return err
 		}
+	}
 
-		return nil
-	})
-	return err
+	return d.putPath(tx, col, name, fp, data)
 }
 
 // Remove removes a particular file from the set of files associated with this fingerprint.
 func (d *Datastore) Remove(col string, fp []byte, name string) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return d.remove(tx, col, fp, name)
+	})
+}
+
+// remove removes a file from a fingerprint within a transaction.
+func (d *Datastore) remove(tx *bolt.Tx, col string, fp []byte, name string) error {
+	root := tx.Bucket([]byte(col))
+	if root == nil {
+		return fmt.Errorf(errTmplBucketNotFound, col)
+	}
+
+	fpBkt := root.Bucket(fp)
+	if fpBkt == nil {
+		return fmt.Errorf(errTmplBucketNotFound, fp)
+	}
+
+	err := fpBkt.DeleteBucket([]byte(name))
+	if err != nil {
+		return err
+	}
+
+	err = deletePath(tx, col, name, fp)
+	if err != nil {
+		return err
+	}
+
+	// the fingerprint goes with its last file
+	if k, _ := fpBkt.Cursor().First(); k != nil {
+		return nil
+	}
+	err = root.DeleteBucket(fp)
+	if err != nil {
+		return err
+	}
+	if err := bumpGeneration(tx, col); err != nil {
+		return err
+	}
+	for _, ix := range d.indexers[col] {
+		if err := ix.Delete(tx, fp); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RemoveEmpty removes the fingerprints that have no files left and returns how many there were.
+func (d *Datastore) RemoveEmpty(col string) (int, error) {
+	var n int
 	err := d.db.Update(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte(col))
 		if root == nil {
-			return fmt.Errorf(errTmplBucketNotFound, col)
+			return nil
 		}
 
-		fpBkt := root.Bucket(fp)
-		if fpBkt == nil {
-			return fmt.Errorf(errTmplBucketNotFound, fp)
+		var empty [][]byte
+		root.ForEach(func(k, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			if f, _ := root.Bucket(k).Cursor().First(); f == nil {
+				empty = append(empty, k)
+			}
+			return nil
+		})
+
+		for _, fp := range empty {
+			if err := root.DeleteBucket(fp); err != nil {
+				return err
+			}
+			if err := bumpGeneration(tx, col); err != nil {
+				return err
+			}
+			for _, ix := range d.indexers[col] {
+				if err := ix.Delete(tx, fp); err != nil {
+					return err
+				}
+			}
+			n++
 		}
+		return nil
+	})
+	return n, err
+}
 
-		err := fpBkt.DeleteBucket([]byte(name))
+// Drop deletes a collection with its path index and returns how many fingerprints and files it held.
+func (d *Datastore) Drop(col string) (int, int, error) {
+	var fps, files int
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(col))
+		if root == nil {
+			return nil
+		}
+		if err := bumpGeneration(tx, col); err != nil {
+			return err
+		}
+
+		err := root.ForEach(func(k, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			fps++
+			files += countBuckets(root.Bucket(k))
+			for _, ix := range d.indexers[col] {
+				if err := ix.Delete(tx, k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
 		if err != nil {
 			return err
 		}
 
+		if err := tx.DeleteBucket([]byte(col)); err != nil {
+			return err
+		}
+		if tx.Bucket([]byte(PathsName(col))) != nil {
+			return tx.DeleteBucket([]byte(PathsName(col)))
+		}
 		return nil
 	})
-	return err
+	return fps, files, err
+}
+
+// RemoveUnder removes the files of a collection that are within one of dirs and returns how many
+// fingerprints and files were removed.
+func (d *Datastore) RemoveUnder(col string, dirs []string) (int, int, error) {
+	var fps, files int
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(col))
+		if root == nil {
+			return nil
+		}
+
+		type entry struct {
+			fp   []byte
+			name string
+		}
+		var doomed []entry
+		left := make(map[string]int)
+		root.ForEach(func(k, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			fpBkt := root.Bucket(k)
+			fpBkt.ForEach(func(name, v []byte) error {
+				if v != nil {
+					return nil
+				}
+				if within(string(name), dirs) {
+					fp := make([]byte, len(k))
+					copy(fp, k)
+					doomed = append(doomed, entry{fp, string(name)})
+				} else {
+					left[string(k)]++
+				}
+				return nil
+			})
+			return nil
+		})
+
+		for _, e := range doomed {
+			if err := d.remove(tx, col, e.fp, e.name); err != nil {
+				return err
+			}
+			files++
+		}
+
+		seen := make(map[string]bool)
+		for _, e := range doomed {
+			if left[string(e.fp)] == 0 && !seen[string(e.fp)] {
+				seen[string(e.fp)] = true
+				fps++
+			}
+		}
+		return nil
+	})
+	return fps, files, err
+}
+
+// within reports whether a path is one of dirs or inside one of them
+func within(name string, dirs []string) bool {
+	name = filepath.Clean(name)
+	for _, dir := range dirs {
+		dir = filepath.Clean(dir)
+		if name == dir || strings.HasPrefix(name, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// countBuckets returns the number of nested buckets of a bucket
+func countBuckets(b *bolt.Bucket) int {
+	var n int
+	b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			n++
+		}
+		return nil
+	})
+	return n
 }
 
 // GetFingerPrints gets the fingerprints
@@ -147,9 +404,13 @@ func (d *Datastore) GetFingerPrints(col string) [][]byte {
 	var res [][]byte
 	d.db.View(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte(col))
+		if root == nil {
+			return nil
+		}
+		// keys are only valid within the transaction
 		root.ForEach(func(k, v []byte) error {
 			if v == nil {
-				res = append(res, k)
+				res = append(res, append([]byte(nil), k...))
 			}
 			return nil
 		})
@@ -163,8 +424,14 @@ func (d *Datastore) GetImages(col string, fp []byte) []string {
 	var res []string
 	d.db.View(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte(col))
+		if root == nil {
+			return nil
+		}
 
 		fpBkt := root.Bucket(fp)
+		if fpBkt == nil {
+			return nil
+		}
 		fpBkt.ForEach(func(k, v []byte) error {
 			if v == nil {
 				res = append(res, string(k))
@@ -2,8 +2,12 @@ package datastore
 
 import (
 	"bytes"
+	"encoding/binary"
 	"os"
 	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
 )
 
 var (
@@ -55,3 +59,263 @@ func TestDataStore(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestAddBatch(t *testing.T) {
+	defer clearDatastore(t)
+
+	ds, err := Open(Config{tstDatastorePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	tstHash := []byte{1, 2, 3}
+	err = ds.AddBatch(tstCollection, []Entry{
+		{FingerPrint: tstHash, Name: "/tmp/a.jpg", Data: map[string][]byte{"key": []byte("a")}},
+		{FingerPrint: tstHash, Name: "/tmp/b.jpg", Data: map[string][]byte{"key": []byte("b")}},
+		{FingerPrint: []byte{4, 5, 6}, Name: "/tmp/c.jpg"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := ds.GetFingerPrints(tstCollection); len(got) != 2 {
+		t.Errorf("fingerprint count mismatch - want: 2, got: %d", len(got))
+	}
+
+	col, err := ds.Get(tstCollection, tstHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(col["/tmp/b.jpg"]["key"]); got != "b" {
+		t.Errorf("value mismatch - want: b, got: %s", got)
+	}
+
+	// a file added again keeps only its new data
+	err = ds.Add(tstCollection, tstHash, "/tmp/b.jpg", map[string][]byte{"other": []byte("b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	col, err = ds.Get(tstCollection, tstHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := col["/tmp/b.jpg"]; len(got) != 1 || string(got["other"]) != "b" {
+		t.Errorf("data of a file added again mismatch - want: map[other:b], got: %s", got)
+	}
+}
+
+func TestPaths(t *testing.T) {
+	defer clearDatastore(t)
+
+	ds, err := Open(Config{tstDatastorePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	tstFileName := "/tmp/my/file/name.jpg"
+	oldHash, newHash := []byte{1, 2, 3}, []byte{4, 5, 6}
+	meta := func(mtime uint64) map[string][]byte {
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, mtime)
+		return map[string][]byte{MetaModTime: buf}
+	}
+
+	if rec, err := ds.GetPath(tstCollection, tstFileName); err != nil || rec != nil {
+		t.Errorf("unknown path found - want: nil, got: %v (%v)", rec, err)
+	}
+
+	err = ds.Add(tstCollection, oldHash, tstFileName, meta(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := ds.GetPath(tstCollection, tstFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec == nil || !bytes.Equal(rec.FingerPrint, oldHash) || !rec.Matches(1, 0, 0) {
+		t.Errorf("path record mismatch - want: %x at mtime 1, got: %v", oldHash, rec)
+	}
+
+	// the content changed, so the file moves to its new fingerprint
+	err = ds.Add(tstCollection, newHash, tstFileName, meta(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ds.GetImages(tstCollection, oldHash); len(got) != 0 {
+		t.Errorf("file still stored under its old fingerprint: %s", got)
+	}
+	if got := ds.GetFingerPrints(tstCollection); len(got) != 1 || !bytes.Equal(got[0], newHash) {
+		t.Errorf("fingerprint mismatch - want: [%x], got: %x", newHash, got)
+	}
+
+	paths, err := ds.GetPaths(tstCollection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, found := paths[tstFileName]; !found || !bytes.Equal(rec.FingerPrint, newHash) || rec.ModTime != 2 {
+		t.Errorf("path record mismatch - want: %x at mtime 2, got: %v", newHash, rec)
+	}
+
+	err = ds.Remove(tstCollection, newHash, tstFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := ds.GetPath(tstCollection, tstFileName); err != nil || rec != nil {
+		t.Errorf("removed path found - want: nil, got: %v (%v)", rec, err)
+	}
+}
+
+func TestRemoveEmpty(t *testing.T) {
+	defer clearDatastore(t)
+
+	ds, err := Open(Config{tstDatastorePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	err = ds.Add(tstCollection, []byte{1}, "/tmp/a.jpg", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an empty fingerprint as left behind by older versions
+	err = ds.Update(func(tx *bolt.Tx) error {
+		_, err := tx.Bucket([]byte(tstCollection)).CreateBucket([]byte{2})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := ds.RemoveEmpty(tstCollection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("removed count mismatch - want: 1, got: %d", n)
+	}
+	if got := ds.GetFingerPrints(tstCollection); len(got) != 1 {
+		t.Errorf("fingerprint count mismatch - want: 1, got: %d", len(got))
+	}
+}
+
+func TestRemoveUnder(t *testing.T) {
+	defer clearDatastore(t)
+
+	ds, err := Open(Config{tstDatastorePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	entries := []Entry{
+		{FingerPrint: []byte{1}, Name: "/tmp/a/1.jpg"},
+		{FingerPrint: []byte{1}, Name: "/tmp/b/1.jpg"},
+		{FingerPrint: []byte{2}, Name: "/tmp/a/2.jpg"},
+		{FingerPrint: []byte{3}, Name: "/tmp/ab/3.jpg"},
+	}
+	if err := ds.AddBatch(tstCollection, entries); err != nil {
+		t.Fatal(err)
+	}
+
+	fps, paths, err := ds.RemoveUnder(tstCollection, []string{"/tmp/a/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fps != 1 || paths != 2 {
+		t.Errorf("removed count mismatch - want: 1 fingerprints, 2 paths, got: %d, %d", fps, paths)
+	}
+	if got := ds.GetImages(tstCollection, []byte{1}); len(got) != 1 || got[0] != "/tmp/b/1.jpg" {
+		t.Errorf("remaining images mismatch - want: [/tmp/b/1.jpg], got: %v", got)
+	}
+	if rec, err := ds.GetPath(tstCollection, "/tmp/a/2.jpg"); err != nil || rec != nil {
+		t.Errorf("removed path found - want: nil, got: %v (%v)", rec, err)
+	}
+
+	fps, paths, err = ds.Drop(tstCollection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fps != 2 || paths != 2 {
+		t.Errorf("dropped count mismatch - want: 2 fingerprints, 2 paths, got: %d, %d", fps, paths)
+	}
+	if got, err := ds.GetPaths(tstCollection); err != nil || len(got) != 0 {
+		t.Errorf("dropped paths found - want: none, got: %v (%v)", got, err)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	defer clearDatastore(t)
+
+	ds, err := Open(Config{tstDatastorePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	if got, err := ds.Journal(); err != nil || len(got) != 0 {
+		t.Errorf("empty journal mismatch - want: none, got: %v (%v)", got, err)
+	}
+
+	now := time.Now().Round(0)
+	for j, path := range []string{"/tmp/a.jpg", "/tmp/b.jpg"} {
+		seq, err := ds.AppendJournal(JournalEntry{Run: "run", Time: now, Action: "delete", Path: path, Hash: []byte{byte(j)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != uint64(j+1) {
+			t.Errorf("sequence mismatch - want: %d, got: %d", j+1, seq)
+		}
+	}
+
+	got, err := ds.Journal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("entry count mismatch - want: 2, got: %d", len(got))
+	}
+	if got[1].Seq != 2 || got[1].Path != "/tmp/b.jpg" || !got[1].Time.Equal(now) || !bytes.Equal(got[1].Hash, []byte{1}) {
+		t.Errorf("entry mismatch - got: %+v", got[1])
+	}
+
+	done, err := ds.AppendJournal(JournalEntry{Run: "run", Time: now, Action: "delete", Path: "/tmp/c.jpg", Pending: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	aborted, err := ds.AppendJournal(JournalEntry{Run: "run", Time: now, Action: "delete", Path: "/tmp/d.jpg", Pending: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.CompleteJournal(done); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.AbortJournal(aborted); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.AbortJournal(1); err == nil {
+		t.Errorf("abort of an entry that is not pending - want: error, got: nil")
+	}
+
+	// the pending entries are still there as they were appended, followed by what became of them
+	records, err := ds.JournalRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 6 || !records[2].Pending || !records[3].Pending ||
+		records[4].Action != JournalDone || records[4].Settles != done ||
+		records[5].Action != JournalAbort || records[5].Settles != aborted || records[5].Run != "run" {
+		t.Errorf("journal records mismatch - got: %+v", records)
+	}
+
+	got, err = ds.Journal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 4 || got[2].Seq != done || got[2].Pending || got[2].Aborted || got[3].Seq != aborted || got[3].Pending || !got[3].Aborted {
+		t.Errorf("journal mismatch after completing and aborting - got: %+v", got)
+	}
+}
@@ -0,0 +1,29 @@
+package datastore
+
+import (
+	"github.com/boltdb/bolt"
+)
+
+// GenerationsName is the name of the bucket that holds the generation of every collection
+const GenerationsName = "generations"
+
+// Generation returns the generation of a collection: a counter that goes up every time a
+// fingerprint is created in or deleted from the collection. Secondary indexes record the
+// generation they saw last, so they can tell they missed a change even when the number of
+// fingerprints came out the same.
+func Generation(tx *bolt.Tx, col string) uint64 {
+	b := tx.Bucket([]byte(GenerationsName))
+	if b == nil {
+		return 0
+	}
+	return Uint64Value(b.Get([]byte(col)))
+}
+
+// bumpGeneration moves a collection to its next generation
+func bumpGeneration(tx *bolt.Tx, col string) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(GenerationsName))
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(col), Uint64Bytes(Generation(tx, col)+1))
+}
@@ -0,0 +1,164 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// JournalName is the name of the bucket that holds the journal of the actions taken on files
+const JournalName = "journal"
+
+// Actions of the records that settle a pending entry
+const (
+	// JournalDone is the action of a record that reports the action of a pending entry was taken
+	JournalDone = "done"
+	// JournalAbort is the action of a record that reports the action of a pending entry was not
+	// taken
+	JournalAbort = "abort"
+)
+
+// JournalEntry records an action taken on a file, or the undoing of one. An action is appended as
+// pending before it is taken, so a crash in between leaves a record of it, and is settled by a
+// done or abort record appended once it is known whether it succeeded. The journal is append
+// only: no record is ever changed or removed, and an undo is an entry of its own that refers to
+// the entry it reverses.
+type JournalEntry struct {
+	// Seq is the position of the entry in the journal, set when it is appended
+	Seq uint64 `json:"-"`
+	// Run identifies the command that took the action; entries of one run share it
+	Run string `json:"run"`
+	// Time is when the action was taken
+	Time time.Time `json:"time"`
+	// Action is what was done to the file
+	Action string `json:"action"`
+	// Path is the original path of the file
+	Path string `json:"path"`
+	// Dest is where the file was moved to, if it was moved
+	Dest string `json:"dest,omitempty"`
+	// Keeper is the file that was kept in its place
+	Keeper string `json:"keeper,omitempty"`
+	// Hash is the SHA-256 of the content of the file before the action
+	Hash []byte `json:"hash,omitempty"`
+	// Undoes is the sequence number of the entry this one reverses
+	Undoes uint64 `json:"undoes,omitempty"`
+	// Settles is the sequence number of the pending entry a done or abort record settles
+	Settles uint64 `json:"settles,omitempty"`
+	// Pending is set while the action may not have been taken yet
+	Pending bool `json:"pending,omitempty"`
+	// Aborted is set by Journal on a pending entry whose action was not taken
+	Aborted bool `json:"-"`
+}
+
+// AppendJournal appends an entry to the journal and returns its sequence number.
+func (d *Datastore) AppendJournal(e JournalEntry) (uint64, error) {
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(JournalName))
+		if err != nil {
+			return err
+		}
+		e.Seq, err = b.NextSequence()
+		if err != nil {
+			return err
+		}
+		v, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		k := make([]byte, 8)
+		binary.BigEndian.PutUint64(k, e.Seq)
+		return b.Put(k, v)
+	})
+	return e.Seq, err
+}
+
+// CompleteJournal records that the action of a pending entry was taken.
+func (d *Datastore) CompleteJournal(seq uint64) error {
+	return d.settleJournal(seq, JournalDone)
+}
+
+// AbortJournal records that the action of a pending entry was not taken.
+func (d *Datastore) AbortJournal(seq uint64) error {
+	return d.settleJournal(seq, JournalAbort)
+}
+
+// settleJournal appends a record of the outcome of a pending entry, in the run of the entry
+func (d *Datastore) settleJournal(seq uint64, action string) error {
+	var e JournalEntry
+	err := d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(JournalName))
+		if b == nil {
+			return fmt.Errorf(errTmplBucketNotFound, JournalName)
+		}
+		k := make([]byte, 8)
+		binary.BigEndian.PutUint64(k, seq)
+		v := b.Get(k)
+		if v == nil {
+			return fmt.Errorf("no journal entry %d", seq)
+		}
+		return json.Unmarshal(v, &e)
+	})
+	if err != nil {
+		return err
+	}
+	if !e.Pending {
+		return fmt.Errorf("journal entry %d is not pending", seq)
+	}
+	_, err = d.AppendJournal(JournalEntry{Run: e.Run, Time: time.Now(), Action: action, Path: e.Path, Settles: seq})
+	return err
+}
+
+// Journal returns the entries of the journal in the order they were appended, with the done and
+// abort records folded into the entries they settle: those are no longer pending, and the
+// aborted ones are marked so.
+func (d *Datastore) Journal() ([]JournalEntry, error) {
+	records, err := d.JournalRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	settled := make(map[uint64]string)
+	for _, e := range records {
+		if e.Action == JournalDone || e.Action == JournalAbort {
+			settled[e.Settles] = e.Action
+		}
+	}
+
+	var res []JournalEntry
+	for _, e := range records {
+		if e.Action == JournalDone || e.Action == JournalAbort {
+			continue
+		}
+		if e.Pending && settled[e.Seq] != "" {
+			e.Pending = false
+			e.Aborted = settled[e.Seq] == JournalAbort
+		}
+		res = append(res, e)
+	}
+	return res, nil
+}
+
+// JournalRecords returns every record of the journal as it was appended, done and abort records
+// included.
+func (d *Datastore) JournalRecords() ([]JournalEntry, error) {
+	var res []JournalEntry
+	err := d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(JournalName))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var e JournalEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			e.Seq = binary.BigEndian.Uint64(k)
+			res = append(res, e)
+			return nil
+		})
+	})
+	return res, err
+}
@@ -0,0 +1,175 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// Metadata keys the datastore reads to keep the path index of a collection
+const (
+	// MetaSize is the size of the file in bytes
+	MetaSize = "size"
+	// MetaModTime is the modification time of the file in unix nanoseconds
+	MetaModTime = "mtime"
+	// MetaInode is the inode number of the file
+	MetaInode = "inode"
+)
+
+// PathRecord is what the datastore knows about a stored file, enough to tell whether it changed.
+type PathRecord struct {
+	ModTime     int64
+	Size        int64
+	Inode       uint64
+	FingerPrint []byte
+}
+
+// Matches reports whether the file still has the recorded modification time, size and inode.
+func (r PathRecord) Matches(modTime, size int64, inode uint64) bool {
+	return r.ModTime == modTime && r.Size == size && r.Inode == inode
+}
+
+// PathsName returns the name of the bucket that maps the paths of a collection to their record
+func PathsName(col string) string {
+	return col + ".paths"
+}
+
+// GetPath gets the record of a stored file, or nil when the file is not in the collection.
+func (d *Datastore) GetPath(col string, name string) (*PathRecord, error) {
+	var res *PathRecord
+	err := d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(PathsName(col)))
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(name))
+		if v == nil {
+			return nil
+		}
+		r, err := decodePath(v)
+		res = &r
+		return err
+	})
+	return res, err
+}
+
+// GetPaths gets the records of every stored file of a collection keyed by path.
+func (d *Datastore) GetPaths(col string) (map[string]PathRecord, error) {
+	res := make(map[string]PathRecord)
+	err := d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(PathsName(col)))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			r, err := decodePath(v)
+			if err != nil {
+				return err
+			}
+			res[string(k)] = r
+			return nil
+		})
+	})
+	return res, err
+}
+
+// putPath records the file data of a stored file; a file stored under another fingerprint
+// before is removed from it, since its content changed.
+func (d *Datastore) putPath(tx *bolt.Tx, col string, name string, fp []byte, data map[string][]byte) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(PathsName(col)))
+	if err != nil {
+		return err
+	}
+
+	if v := b.Get([]byte(name)); v != nil {
+		old, err := decodePath(v)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(old.FingerPrint, fp) && stored(tx, col, old.FingerPrint, name) {
+			if err := d.remove(tx, col, old.FingerPrint, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	r := PathRecord{
+		ModTime:     int64(Uint64Value(data[MetaModTime])),
+		Size:        int64(Uint64Value(data[MetaSize])),
+		Inode:       Uint64Value(data[MetaInode]),
+		FingerPrint: fp,
+	}
+	return b.Put([]byte(name), encodePath(r))
+}
+
+// deletePath forgets a stored file, unless it has been stored under another fingerprint since.
+func deletePath(tx *bolt.Tx, col string, name string, fp []byte) error {
+	b := tx.Bucket([]byte(PathsName(col)))
+	if b == nil {
+		return nil
+	}
+	v := b.Get([]byte(name))
+	if v == nil {
+		return nil
+	}
+	r, err := decodePath(v)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(r.FingerPrint, fp) {
+		return nil
+	}
+	return b.Delete([]byte(name))
+}
+
+// stored reports whether a file is stored under a fingerprint
+func stored(tx *bolt.Tx, col string, fp []byte, name string) bool {
+	root := tx.Bucket([]byte(col))
+	if root == nil {
+		return false
+	}
+	fpBkt := root.Bucket(fp)
+	return fpBkt != nil && fpBkt.Bucket([]byte(name)) != nil
+}
+
+// Uint64Value returns the big endian uint64 of a metadata value, or 0 when it is not one
+func Uint64Value(v []byte) uint64 {
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+// Uint64Bytes returns the big endian bytes of an uint64, as numeric metadata values are stored
+func Uint64Bytes(n uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, n)
+	return buf
+}
+
+// encodePath serializes a path record
+func encodePath(r PathRecord) []byte {
+	buf := make([]byte, 24+len(r.FingerPrint))
+	binary.BigEndian.PutUint64(buf[0:], uint64(r.ModTime))
+	binary.BigEndian.PutUint64(buf[8:], uint64(r.Size))
+	binary.BigEndian.PutUint64(buf[16:], r.Inode)
+	copy(buf[24:], r.FingerPrint)
+	return buf
+}
+
+// decodePath deserializes a path record
+func decodePath(v []byte) (PathRecord, error) {
+	if len(v) < 24 {
+		return PathRecord{}, fmt.Errorf("invalid path record length: %d", len(v))
+	}
+	fp := make([]byte, len(v)-24)
+	copy(fp, v[24:])
+	return PathRecord{
+		ModTime:     int64(binary.BigEndian.Uint64(v[0:])),
+		Size:        int64(binary.BigEndian.Uint64(v[8:])),
+		Inode:       binary.BigEndian.Uint64(v[16:]),
+		FingerPrint: fp,
+	}, nil
+}
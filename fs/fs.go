@@ -1,7 +1,9 @@
 package fs
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 
@@ -18,12 +20,22 @@ type Matcher interface {
 	Patterns() []string
 }
 
+// ContentMatcher is a Matcher that looks into the files to decide. Its patterns narrow down the
+// files it looks into; without patterns it looks into every file.
+type ContentMatcher interface {
+	Matcher
+	// Match returns the format of the file at path, or "" when it is not a file to find
+	Match(path string) string
+}
+
 // Path is used to search for images in the specified root path.
 type Path struct {
 	Name         string
 	Root         *os.File
 	RootFileInfo os.FileInfo
 	Matchers     []Matcher
+	// Formats are the formats content matchers found, by path; Find fills it
+	Formats map[string]string
 }
 
 // NewPath creates a new path
@@ -47,25 +59,23 @@ func NewPath(root string, matchers []Matcher) (*Path, error) {
 		Root:         fd,
 		RootFileInfo: fi,
 		Matchers:     matchers,
+		Formats:      make(map[string]string),
 	}, nil
 }
 
-// Find finds all files in the specified dir directory and returns a list of paths.
+// Find finds all files in the specified dir directory and returns a list of paths. A file is
+// found when any of the matchers matches it; content matchers only match regular files.
 func (p *Path) Find() ([]string, error) {
 	var paths = []string{}
 	err := filepath.Walk(p.Root.Name(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Error(err)
+			return nil
+		}
 		for _, match := range p.Matchers {
-			for _, pattern := range match.Patterns() {
-				if matched, err := filepath.Match(pattern, filepath.Base(path)); err == nil {
-					if matched {
-						paths = append(paths, path)
-						log.Debugf("path matched on pattern %s: %s", pattern, path)
-					} else {
-						log.Debugf("path NO MATCH on pattern %s: %s", pattern, path)
-					}
-				} else {
-					log.Error(err)
-				}
+			if p.match(match, path, info) {
+				paths = append(paths, path)
+				break
 			}
 		}
 		return nil
@@ -75,3 +85,52 @@ func (p *Path) Find() ([]string, error) {
 	}
 	return paths, nil
 }
+
+// match reports whether a matcher matches a file, and records the format a content matcher found
+func (p *Path) match(match Matcher, path string, info os.FileInfo) bool {
+	cm, sniffs := match.(ContentMatcher)
+	if sniffs && !info.Mode().IsRegular() {
+		return false
+	}
+
+	named := sniffs && len(match.Patterns()) == 0
+	for _, pattern := range match.Patterns() {
+		if matched, err := filepath.Match(pattern, filepath.Base(path)); err == nil {
+			if matched {
+				log.Debugf("path matched on pattern %s: %s", pattern, path)
+				named = true
+				break
+			}
+			log.Debugf("path NO MATCH on pattern %s: %s", pattern, path)
+		} else {
+			log.Error(err)
+		}
+	}
+	if !named || !sniffs {
+		return named
+	}
+
+	format := cm.Match(path)
+	if format == "" {
+		log.Debugf("path NO MATCH on content: %s", path)
+		return false
+	}
+	log.Debugf("path matched on content as %s: %s", format, path)
+	p.Formats[path] = format
+	return true
+}
+
+// ContentHash returns the SHA-256 of the bytes of a file, read as a stream
+func ContentHash(path string) ([]byte, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, fd); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
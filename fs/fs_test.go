@@ -1,7 +1,10 @@
 package fs
 
 import (
+	"crypto/sha256"
+	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/marklap/imgdupdetect/img"
@@ -41,3 +44,182 @@ func TestPath(t *testing.T) {
 	}
 
 }
+
+func TestContentHash(t *testing.T) {
+	tstFile := "hashtest.tmp"
+	content := []byte("not really an image")
+	err := os.WriteFile(tstFile, content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tstFile)
+
+	got, err := ContentHash(tstFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := sha256.Sum256(content)
+	if fmt.Sprintf("%x", got) != fmt.Sprintf("%x", want) {
+		t.Errorf("hash mismatch - want: %x, got: %x", want, got)
+	}
+
+	if _, err := ContentHash("lkjsdlfjalksdjflkjsadf"); err == nil {
+		t.Errorf("nonsense file was hashed - want: error, got: nil")
+	}
+}
+
+func TestMove(t *testing.T) {
+	dir, err := os.MkdirTemp("", "imgdd-fs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "a.tmp")
+	if err := os.WriteFile(src, []byte("a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "sub", "dir", "a.tmp")
+	if err := Move(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("source still exists after move")
+	}
+	if got, err := os.ReadFile(dst); err != nil || string(got) != "a" {
+		t.Errorf("moved content mismatch - want: a, got: %s (%v)", got, err)
+	}
+
+	if err := os.WriteFile(src, []byte("b"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Move(src, dst); err == nil {
+		t.Errorf("move over an existing file - want: error, got: nil")
+	}
+	if err := Copy(src, dst); err == nil {
+		t.Errorf("copy over an existing file - want: error, got: nil")
+	}
+}
+
+func TestCopyVerified(t *testing.T) {
+	dir, err := os.MkdirTemp("", "imgdd-fs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "a.tmp")
+	if err := os.WriteFile(src, []byte("a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "sub", "a.tmp")
+	if err := CopyVerified(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("source missing after copy: %s", err)
+	}
+	if got, err := os.ReadFile(dst); err != nil || string(got) != "a" {
+		t.Errorf("copied content mismatch - want: a, got: %s (%v)", got, err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(dst)); len(entries) != 1 {
+		t.Errorf("files next to the copy - want: 1, got: %d", len(entries))
+	}
+
+	if err := CopyVerified(src, dst); err == nil {
+		t.Errorf("copy over an existing file - want: error, got: nil")
+	}
+}
+
+func TestReplaceWithLink(t *testing.T) {
+	dir, err := os.MkdirTemp("", "imgdd-fs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "target.tmp")
+	if err := os.WriteFile(target, []byte("target"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, symbolic := range []bool{false, true} {
+		path := filepath.Join(dir, fmt.Sprintf("dup-%t.tmp", symbolic))
+		if err := os.WriteFile(path, []byte("dup"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := ReplaceWithLink(path, target, symbolic); err != nil {
+			t.Fatal(err)
+		}
+
+		fi, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isLink := fi.Mode()&os.ModeSymlink != 0; isLink != symbolic {
+			t.Errorf("link type mismatch - want symbolic: %t, got: %t", symbolic, isLink)
+		}
+		if got, err := os.ReadFile(path); err != nil || string(got) != "target" {
+			t.Errorf("linked content mismatch - want: target, got: %s (%v)", got, err)
+		}
+	}
+}
+
+func TestFindContent(t *testing.T) {
+	dir, err := os.MkdirTemp("", "imgdd-fs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"photo":     "\xff\xd8\xff\xe0\x00\x10JFIF\x00",
+		"photo.jpe": "\xff\xd8\xff\xe1\x00\x10Exif\x00",
+		"notes.jpg": "not really an image",
+		"scan.gif":  "not really an image",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path, err := NewPath(dir, []Matcher{img.ContentMatch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, err := path.Find()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(dir, "photo"), filepath.Join(dir, "photo.jpe")}
+	if fmt.Sprint(paths) != fmt.Sprint(want) {
+		t.Errorf("paths mismatch - want: %s, got: %s", want, paths)
+	}
+	for _, p := range want {
+		if path.Formats[p] != "jpeg" {
+			t.Errorf("format of %s mismatch - want: jpeg, got: %s", p, path.Formats[p])
+		}
+	}
+
+	// the patterns of a content matcher narrow down the files it looks into, and glob matchers
+	// still match by name
+	path, err = NewPath(dir, []Matcher{img.NewSniffMatch([]string{"*.jpe"}), img.GIFMatch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, err = path.Find()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{filepath.Join(dir, "photo.jpe"), filepath.Join(dir, "scan.gif")}
+	if fmt.Sprint(paths) != fmt.Sprint(want) {
+		t.Errorf("paths mismatch - want: %s, got: %s", want, paths)
+	}
+	if _, found := path.Formats[filepath.Join(dir, "scan.gif")]; found {
+		t.Errorf("glob match recorded a format")
+	}
+}
@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package fs
+
+import "os"
+
+// Inode returns the inode number of a file; Windows has none, so it is always 0
+func Inode(fi os.FileInfo) uint64 {
+	return 0
+}
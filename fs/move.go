@@ -0,0 +1,162 @@
+package fs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+var (
+	errTargetExists = fmt.Errorf("target already exists")
+	errCopyMismatch = fmt.Errorf("copy does not match its source")
+)
+
+// Copy copies a file to a path that must not exist yet and syncs it to disk before returning.
+// The copy keeps the permissions and modification time of the source.
+func Copy(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("%w: %s", errTargetExists, dst)
+		}
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
+
+// Move moves a file to a path that must not exist yet, creating its directory. Moves across
+// file systems fall back to a verified copy before the source is removed.
+func Move(src, dst string) error {
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("%w: %s", errTargetExists, dst)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	err := os.Rename(src, dst)
+	if err == nil {
+		syncDir(filepath.Dir(dst))
+		return nil
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	if err := CopyVerified(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// CopyVerified copies a file to a path that must not exist yet, creating its directory. The copy
+// is written under a temporary name, synced, read back and compared with the hash of the source
+// before it is renamed into place, so dst never holds a partial or corrupt file.
+func CopyVerified(src, dst string) error {
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("%w: %s", errTargetExists, dst)
+	}
+	dir := filepath.Dir(dst)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(dir, "."+filepath.Base(dst)+".imgdd-copy")
+	os.Remove(tmp)
+	if err := Copy(src, tmp); err != nil {
+		return err
+	}
+
+	want, err := ContentHash(src)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	got, err := ContentHash(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if !bytes.Equal(want, got) {
+		os.Remove(tmp)
+		return fmt.Errorf("%w: %s", errCopyMismatch, dst)
+	}
+
+	if _, err := os.Lstat(dst); err == nil {
+		os.Remove(tmp)
+		return fmt.Errorf("%w: %s", errTargetExists, dst)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir flushes a directory entry to disk where the platform allows it
+func syncDir(dir string) {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	fd.Sync()
+	fd.Close()
+}
+
+// ReplaceWithLink replaces a file with a hard link, or a symbolic link when symbolic is set, to
+// target. The link is made next to the file and renamed over it, so the file is never missing.
+func ReplaceWithLink(path, target string, symbolic bool) error {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".imgdd-link")
+	os.Remove(tmp)
+
+	var err error
+	if symbolic {
+		var abs string
+		abs, err = filepath.Abs(target)
+		if err == nil {
+			err = os.Symlink(abs, tmp)
+		}
+	} else {
+		err = os.Link(target, tmp)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package img
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// Sources of the date an image was taken, as DateTaken accepts them
+const (
+	// DateExifOriginal is the EXIF DateTimeOriginal tag, when the shutter was pressed
+	DateExifOriginal = "exif-original"
+	// DateExifDateTime is the EXIF DateTime tag, when the file was last changed by the camera or
+	// an editor
+	DateExifDateTime = "exif-datetime"
+	// DateGPS is the UTC time of the EXIF GPS fix
+	DateGPS = "gps"
+	// DateFileName is a date in the file name, such as IMG_20190312_143015.jpg
+	DateFileName = "filename"
+	// DateModTime is the modification time of the file
+	DateModTime = "mtime"
+)
+
+// DateSources are the date sources in the order DateTaken tries them by default
+var DateSources = []string{DateExifOriginal, DateExifDateTime, DateGPS, DateFileName, DateModTime}
+
+// exifTimeLayout is how EXIF writes dates
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+// fileNameDate finds a date, optionally followed by a time, in a file name
+var fileNameDate = regexp.MustCompile(`(?:^|\D)((?:19|20)\d\d)[-_.]?(\d\d)[-_.]?(\d\d)(?:[-_ T.]?(\d\d)[-_.:h]?(\d\d)[-_.:m]?(\d\d))?`)
+
+// Camera describes the camera an image was taken with according to its EXIF data
+type Camera struct {
+	Make  string
+	Model string
+	Lens  string
+}
+
+// ExifCamera returns the camera the image at path was taken with; fields the image has no EXIF tag
+// for are empty. Unlike NewImage it does not need to understand the pixel format of the file.
+func ExifCamera(path string) (Camera, error) {
+	x, err := decodeExif(path)
+	if err != nil {
+		return Camera{}, err
+	}
+	return Camera{
+		Make:  exifString(x, exif.Make),
+		Model: exifString(x, exif.Model),
+		Lens:  exifString(x, exif.LensModel),
+	}, nil
+}
+
+// ParseDateSources parses a comma separated list of date sources
+func ParseDateSources(s string) ([]string, error) {
+	var res []string
+	for _, src := range strings.Split(s, ",") {
+		src = strings.TrimSpace(src)
+		if src == "" {
+			continue
+		}
+		found := false
+		for _, known := range DateSources {
+			found = found || src == known
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown date source: %s", src)
+		}
+		res = append(res, src)
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no date sources")
+	}
+	return res, nil
+}
+
+// DateTaken returns the date the image at path was taken from the first of the sources that has
+// one, and the name of that source. An image none of the sources knows a date for gets the zero
+// time and an empty source; that is not an error. Files without EXIF data, such as PNGs and
+// screenshots, simply skip the EXIF sources.
+func DateTaken(path string, sources []string) (time.Time, string, error) {
+	var x *exif.Exif
+	decoded := false
+
+	for _, src := range sources {
+		var dt time.Time
+		switch src {
+		case DateExifOriginal, DateExifDateTime, DateGPS:
+			if !decoded {
+				decoded = true
+				x, _ = decodeExif(path)
+			}
+			if x == nil {
+				continue
+			}
+			switch src {
+			case DateExifOriginal:
+				dt = exifTime(x, exif.DateTimeOriginal)
+			case DateExifDateTime:
+				dt = exifTime(x, exif.DateTime)
+			case DateGPS:
+				dt = gpsTime(x)
+			}
+		case DateFileName:
+			dt = dateFromName(filepath.Base(path))
+		case DateModTime:
+			fi, err := os.Stat(path)
+			if err != nil {
+				return time.Time{}, "", err
+			}
+			dt = fi.ModTime()
+		default:
+			return time.Time{}, "", fmt.Errorf("unknown date source: %s", src)
+		}
+		if !dt.IsZero() {
+			return dt, src, nil
+		}
+	}
+	return time.Time{}, "", nil
+}
+
+// decodeExif reads the EXIF data of the file at path
+func decodeExif(path string) (*exif.Exif, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	return exif.Decode(fd)
+}
+
+// exifString returns the trimmed value of a string tag, or an empty string when there is none
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+// exifTime returns the local time of a date tag, or the zero time when there is no valid one
+func exifTime(x *exif.Exif, name exif.FieldName) time.Time {
+	dt, err := time.ParseInLocation(exifTimeLayout, exifString(x, name), time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return dt
+}
+
+// gpsTime returns the UTC time of the GPS fix, or the zero time when there is none
+func gpsTime(x *exif.Exif) time.Time {
+	date, err := time.ParseInLocation("2006:01:02", exifString(x, exif.GPSDateStamp), time.UTC)
+	if err != nil {
+		return time.Time{}
+	}
+	tag, err := x.Get(exif.GPSTimeStamp)
+	if err != nil {
+		return date
+	}
+
+	var secs float64
+	for j, unit := range []float64{3600, 60, 1} {
+		num, den, err := tag.Rat2(j)
+		if err != nil || den == 0 {
+			return date
+		}
+		secs += float64(num) / float64(den) * unit
+	}
+	return date.Add(time.Duration(secs * float64(time.Second)))
+}
+
+// dateFromName returns the local time of a date in a file name, or the zero time when there is
+// no valid one. The time of day is midnight unless it follows the date.
+func dateFromName(name string) time.Time {
+	for _, m := range fileNameDate.FindAllStringSubmatch(name, -1) {
+		n := make([]int, 6)
+		for j := range n {
+			n[j], _ = strconv.Atoi(m[j+1])
+		}
+		if n[3] > 23 || n[4] > 59 || n[5] > 59 {
+			n[3], n[4], n[5] = 0, 0, 0
+		}
+		dt := time.Date(n[0], time.Month(n[1]), n[2], n[3], n[4], n[5], 0, time.Local)
+		// time.Date normalizes overflows, so a month of 13 or a 31st of February comes back changed
+		if dt.Year() == n[0] && int(dt.Month()) == n[1] && dt.Day() == n[2] {
+			return dt
+		}
+	}
+	return time.Time{}
+}
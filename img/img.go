@@ -3,16 +3,21 @@ package img
 import (
 	"crypto/sha256"
 	"encoding/binary"
+	"fmt"
 	"image"
+	"image/jpeg"
+	"io"
 	"math"
 	"os"
 
-	_ "image/gif"  // registers gif encoding
-	_ "image/jpeg" // registers jpg encoding
-	_ "image/png"  // registers png encoding
+	_ "image/gif" // registers gif encoding
+	_ "image/png" // registers png encoding
 
-	_ "golang.org/x/image/tiff" // registers tiff encodign
+	_ "golang.org/x/image/bmp"  // registers bmp encoding
+	"golang.org/x/image/tiff"   // registers tiff encodign
+	_ "golang.org/x/image/webp" // registers webp encoding
 
+	"github.com/rwcarlsen/goexif/exif"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -46,22 +51,37 @@ var (
 	// PNGMatch matches png files
 	PNGMatch = &ImageMatch{[]string{"*.png", "*.PNG"}}
 	// TIFFMatch matches tiff files
-	TIFFMatch = &ImageMatch{[]string{"*.cr2", "*.CR2", "*.tiff", "*.TIFF"}}
+	TIFFMatch = &ImageMatch{[]string{"*.tif", "*.TIF", "*.tiff", "*.TIFF"}}
+	// RAWMatch matches the camera raw files whose embedded JPEG previews are decoded
+	RAWMatch = &ImageMatch{[]string{"*.cr2", "*.CR2", "*.nef", "*.NEF", "*.arw", "*.ARW", "*.dng", "*.DNG"}}
+	// WebPMatch matches webp files
+	WebPMatch = &ImageMatch{[]string{"*.webp", "*.WEBP"}}
+	// BMPMatch matches bmp files
+	BMPMatch = &ImageMatch{[]string{"*.bmp", "*.BMP"}}
 )
 
-// Image represents an image file
+// Image represents an image file, or a page of a multi-page TIFF when Path is a name made by
+// PageName
 type Image struct {
 	Path     string
 	Type     string
 	Config   image.Config
 	FileInfo os.FileInfo
+	// Orientation is the EXIF orientation (1-8) of the stored pixels; 1 when there is none
+	Orientation int
+
+	// preview locates the embedded JPEG of a raw file, which is decoded in place of the file
+	preview *preview
+	// page is the page of a multi-page TIFF, numbered from 1; 0 for other files
+	page int
 }
 
 // NewImage creates a new Image
 func NewImage(path string) (*Image, error) {
 	log.Debugf("creating Image for path: %s", path)
 
-	fd, err := os.Open(path)
+	file, page := SplitPage(path)
+	fd, err := os.Open(file)
 	if err != nil {
 		return nil, err
 	}
@@ -72,19 +92,99 @@ func NewImage(path string) (*Image, error) {
 		return nil, err
 	}
 
-	imgCfg, imgType, err := image.DecodeConfig(fd)
+	var imgCfg image.Config
+	var imgType string
+	var pv *preview
+	// the content decides how the file is decoded, since its name may not tell
+	format := sniffFile(fd, file)
+	switch {
+	case IsRAW(file) || format == "cr2":
+		var p preview
+		p, imgCfg, err = rawPreview(fd, fi.Size())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		imgType, pv = "jpeg", &p
+	case page > 0:
+		r, err := newPageReader(fd, fi.Size(), page)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		if imgCfg, err = tiff.DecodeConfig(r); err != nil {
+			return nil, err
+		}
+		imgType = "tiff"
+	default:
+		imgCfg, imgType, err = image.DecodeConfig(fd)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = fd.Seek(0, io.SeekStart)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Image{
-		Path:     path,
-		Type:     imgType,
-		Config:   imgCfg,
-		FileInfo: fi,
+		Path:        path,
+		Type:        imgType,
+		Config:      imgCfg,
+		FileInfo:    fi,
+		Orientation: exifOrientation(fd),
+		preview:     pv,
+		page:        page,
 	}, nil
 }
 
+// exifOrientation returns the EXIF orientation of an image, or 1 when it has none
+func exifOrientation(r io.Reader) int {
+	x, err := exif.Decode(r)
+	if err != nil {
+		return 1
+	}
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 1
+	}
+	o, err := tag.Int(0)
+	if err != nil || o < 1 || o > 8 {
+		return 1
+	}
+	return o
+}
+
+// decode reads the pixel data of the image, turned upright according to its EXIF orientation
+func (i *Image) decode() (image.Image, error) {
+	file, _ := SplitPage(i.Path)
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var img image.Image
+	switch {
+	case i.preview != nil:
+		img, err = jpeg.Decode(io.NewSectionReader(fd, i.preview.offset, i.preview.length))
+	case i.page > 0:
+		var r *io.SectionReader
+		if r, err = newPageReader(fd, i.FileInfo.Size(), i.page); err == nil {
+			img, err = tiff.Decode(r)
+		}
+	default:
+		img, _, err = image.Decode(fd)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if t := OrientationTransform(i.Orientation); t != Identity {
+		return newOriented(img, t), nil
+	}
+	return img, nil
+}
+
 // midPoints find the middle
 func midPoints(w, h int) (x, y int) {
 	return int(math.Floor(float64(w) / 2.0)), int(math.Floor(float64(h) / 2.0))
@@ -95,19 +195,13 @@ func (i *Image) FingerPrint() ([]byte, error) {
 	log.Debugf("fingerprinting %s", i.Path)
 	buf := make([]byte, (i.Config.Width+i.Config.Height)*8) // 8 bytes for size + (2 bytes per color (0xffff), 4 colors in a pixel (rgba), 8 bytes per pixel)
 
-	fd, err := os.Open(i.Path)
-	if err != nil {
-		return nil, err
-	}
-	defer fd.Close()
-
-	image, _, err := image.Decode(fd)
+	image, err := i.decode()
 	if err != nil {
 		return nil, err
 	}
 
 	bounds := image.Bounds()
-	midX, midY := midPoints(i.Config.Width, i.Config.Height)
+	midX, midY := midPoints(bounds.Dx(), bounds.Dy())
 
 	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
 		startOffset := (y - bounds.Min.Y) * 8 // the start of the slice
@@ -121,7 +215,7 @@ func (i *Image) FingerPrint() ([]byte, error) {
 	}
 
 	for x := bounds.Min.X; x < bounds.Max.X; x++ {
-		startOffset := (i.Config.Height + x - bounds.Min.X) * 8 // the start of the slice
+		startOffset := (bounds.Dy() + x - bounds.Min.X) * 8 // the start of the slice
 
 		r, g, b, a := image.At(x, midY).RGBA()
 		for j, c := range []uint32{r, g, b, a} {
@@ -144,13 +238,19 @@ func (i *Image) Size() uint64 {
 	return uint64(i.FileInfo.Size())
 }
 
-// Height returns the height of the image
+// Height returns the height of the upright image
 func (i *Image) Height() uint64 {
+	if OrientationTransform(i.Orientation).Swaps() {
+		return uint64(i.Config.Width)
+	}
 	return uint64(i.Config.Height)
 }
 
-// Width returns the width of the image
+// Width returns the width of the upright image
 func (i *Image) Width() uint64 {
+	if OrientationTransform(i.Orientation).Swaps() {
+		return uint64(i.Config.Height)
+	}
 	return uint64(i.Config.Width)
 }
 
@@ -169,6 +269,11 @@ func (i *Image) WidthByteSlice() []byte {
 	return uint64ToByteSlice(i.Width())
 }
 
+// OrientationByteSlice returns the EXIF orientation of the image in a byte array
+func (i *Image) OrientationByteSlice() []byte {
+	return uint64ToByteSlice(uint64(i.Orientation))
+}
+
 // uint64ToByteSlice returns a byte slice representing the int
 func uint64ToByteSlice(i uint64) []byte {
 	buf := make([]byte, 8)
@@ -1,11 +1,18 @@
 package img
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"image"
+	"image/jpeg"
 	"os"
 	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
+
+	"golang.org/x/image/bmp"
 )
 
 var (
@@ -114,3 +121,802 @@ func BenchmarkFingerPrint(b *testing.B) {
 		}
 	}
 }
+
+func TestPerceptualFingerPrint(t *testing.T) {
+	for _, algo := range []string{AlgoDHash, AlgoAHash, AlgoPHash} {
+		orig, err := NewImage(tstImageOrig)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fper, err := NewFingerPrinter(algo, orig)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		origFp, err := fper.FingerPrint()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(origFp) != 8 {
+			t.Errorf("%s fingerprint length mismatch - want: 8, got: %d", algo, len(origFp))
+		}
+
+		origSum := fmt.Sprintf("%x", origFp)
+
+		for _, tstImg := range []string{tstImageCopy, tstImageGrow, tstImageSharp, tstImageShrink} {
+			i, err := NewImage(tstImg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fper, err := NewFingerPrinter(algo, i)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			f, err := fper.FingerPrint()
+			if err != nil {
+				t.Error(err)
+			}
+
+			if s := fmt.Sprintf("%x", f); origSum != s {
+				t.Errorf("%s duplicate detection failed for %s - want: %s, got: %s", algo, tstImg, origSum, s)
+			}
+		}
+	}
+
+	if _, err := NewFingerPrinter("nonsense", nil); err == nil {
+		t.Errorf("unknown algorithm accepted - want: error, got: nil")
+	}
+}
+
+func TestDistance(t *testing.T) {
+	for _, tst := range []struct {
+		a, b []byte
+		want int
+	}{
+		{[]byte{0x00}, []byte{0x00}, 0},
+		{[]byte{0xff}, []byte{0x00}, 8},
+		{[]byte{0x0f, 0x01}, []byte{0x0e, 0x03}, 2},
+		{[]byte{0x01, 0xff}, []byte{0x01}, 8},
+	} {
+		if got := Distance(tst.a, tst.b); got != tst.want {
+			t.Errorf("distance mismatch for %x and %x - want: %d, got: %d", tst.a, tst.b, tst.want, got)
+		}
+	}
+}
+
+func TestTransform(t *testing.T) {
+	g := &grid{w: 3, h: 2, px: []float64{1, 2, 3, 4, 5, 6}}
+
+	for _, tst := range []struct {
+		t    Transform
+		want []float64
+	}{
+		{Identity, []float64{1, 2, 3, 4, 5, 6}},
+		{Rotate90, []float64{4, 1, 5, 2, 6, 3}},
+		{Rotate180, []float64{6, 5, 4, 3, 2, 1}},
+		{Rotate270, []float64{3, 6, 2, 5, 1, 4}},
+		{FlipH, []float64{3, 2, 1, 6, 5, 4}},
+		{Transverse, []float64{6, 3, 5, 2, 4, 1}},
+		{FlipV, []float64{4, 5, 6, 1, 2, 3}},
+		{Transpose, []float64{1, 4, 2, 5, 3, 6}},
+	} {
+		got := g.transform(tst.t)
+		if !reflect.DeepEqual(got.px, tst.want) {
+			t.Errorf("%s mismatch - want: %v, got: %v", tst.t, tst.want, got.px)
+		}
+	}
+
+	for _, a := range Transforms {
+		if got := g.transform(a).transform(a.Inverse()); !reflect.DeepEqual(got.px, g.px) {
+			t.Errorf("inverse of %s does not restore the grid - got: %v", a, got.px)
+		}
+		for _, b := range Transforms {
+			want := g.transform(a).transform(b)
+			if got := g.transform(a.Then(b)); !reflect.DeepEqual(got.px, want.px) {
+				t.Errorf("%s then %s mismatch - want: %v, got: %v", a, b, want.px, got.px)
+			}
+		}
+	}
+}
+
+// writeTransformed saves a transformed copy of an image as a jpeg in a temp file, tagged with
+// an EXIF orientation unless orientation is 0
+func writeTransformed(t *testing.T, path string, tr Transform, orientation byte) string {
+	i, err := NewImage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := i.decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if tr.Swaps() {
+		w, h = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			tx, ty := tr.Point(x, y, b.Dx(), b.Dy())
+			dst.Set(tx, ty, src.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+
+	fd, err := os.CreateTemp("", "imgdd-*.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.Bytes()
+	if orientation > 0 {
+		// APP1 segment holding a big endian TIFF header and a single orientation IFD entry
+		app1 := []byte{
+			0xff, 0xe1, 0x00, 0x22, 'E', 'x', 'i', 'f', 0x00, 0x00,
+			'M', 'M', 0x00, 0x2a, 0x00, 0x00, 0x00, 0x08,
+			0x00, 0x01,
+			0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, orientation, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00,
+		}
+		out = append(append(append([]byte{}, out[:2]...), app1...), out[2:]...)
+	}
+
+	if _, err := fd.Write(out); err != nil {
+		t.Fatal(err)
+	}
+	return fd.Name()
+}
+
+func TestOrientation(t *testing.T) {
+	orig, err := NewImage(tstImageOrig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fper, err := NewFingerPrinter(AlgoPHash, orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origFp, err := fper.FingerPrint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for o := 2; o <= 8; o++ {
+		// store the pixels so that honoring the orientation turns them upright again
+		path := writeTransformed(t, tstImageOrig, OrientationTransform(o).Inverse(), byte(o))
+		defer os.Remove(path)
+
+		i, err := NewImage(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i.Orientation != o {
+			t.Errorf("orientation mismatch - want: %d, got: %d", o, i.Orientation)
+		}
+		if i.Width() != uint64(tstImageWidth) || i.Height() != uint64(tstImageHeight) {
+			t.Errorf("upright size mismatch for orientation %d - want: %dx%d, got: %dx%d", o, tstImageWidth, tstImageHeight, i.Width(), i.Height())
+		}
+
+		fper, err := NewFingerPrinter(AlgoPHash, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fp, err := fper.FingerPrint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := Distance(origFp, fp); d > 2 {
+			t.Errorf("orientation %d copy not matched - want: distance <= 2, got: %d", o, d)
+		}
+	}
+}
+
+func TestDihedralFingerPrint(t *testing.T) {
+	orig, err := NewImage(tstImageOrig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fper, err := NewFingerPrinter(AlgoPHash+DihedralSuffix, orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origFp, origT, err := fper.(CanonicalFingerPrinter).Canonical()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tr := range []Transform{Rotate90, FlipH, Transpose} {
+		path := writeTransformed(t, tstImageOrig, tr, 0)
+		defer os.Remove(path)
+
+		i, err := NewImage(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fper, err := NewFingerPrinter(AlgoPHash+DihedralSuffix, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fp, fpT, err := fper.(CanonicalFingerPrinter).Canonical()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if d := Distance(origFp, fp); d > 2 {
+			t.Errorf("%s copy not matched - want: distance <= 2, got: %d", tr, d)
+		}
+		if got := origT.Then(fpT.Inverse()); got != tr {
+			t.Errorf("detected transform mismatch - want: %s, got: %s", tr, got)
+		}
+	}
+}
+
+func TestKeyPoints(t *testing.T) {
+	i, err := NewImage(tstImageOrig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, orig, err := (&KeyPoints{i}).FingerPrintKeyPoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a quarter of the original, taken at an offset that does not line up with the keypoint scale
+	crop := image.Rect(301, 203, 1101, 803)
+	path := writeCropped(t, tstImageOrig, crop)
+	defer os.Remove(path)
+
+	for _, tst := range []struct {
+		path string
+		want bool
+	}{
+		{path, true},
+		{tstImageCrop, true},
+		{tstImageSharp, false}, // same size, so a duplicate rather than a crop
+	} {
+		i, err := NewImage(tst.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, s, err := (&KeyPoints{i}).FingerPrintKeyPoints()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, found := s.ContainedIn(orig)
+		if found != tst.want {
+			t.Errorf("containment of %s mismatch - want: %t, got: %t", tst.path, tst.want, found)
+			continue
+		}
+		if _, found := orig.ContainedIn(s); found && tst.path == path {
+			t.Errorf("original found in its crop %s", tst.path)
+		}
+		if tst.path != path {
+			continue
+		}
+		if abs(got.DX-crop.Min.X) > offsetTolerance || abs(got.DY-crop.Min.Y) > offsetTolerance {
+			t.Errorf("crop offset mismatch - want: %d,%d, got: %d,%d", crop.Min.X, crop.Min.Y, got.DX, got.DY)
+		}
+		if got.Overlap < 0.24 || got.Overlap > 0.26 {
+			t.Errorf("crop overlap mismatch - want: 0.25, got: %f", got.Overlap)
+		}
+
+		enc, err := DecodeKeyPoints(EncodeKeyPoints(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(enc, s) {
+			t.Errorf("keypoint encoding mismatch - want: %v, got: %v", s, enc)
+		}
+	}
+
+	flipped := writeTransformed(t, tstImageOrig, FlipH, 0)
+	defer os.Remove(flipped)
+	i, err = NewImage(flipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, s, err := (&KeyPoints{i}).FingerPrintKeyPoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := s.ContainedIn(orig); found {
+		t.Errorf("mirrored copy found as a crop")
+	}
+}
+
+// writeCropped saves a region of an image as a jpeg in a temp file
+func writeCropped(t *testing.T, path string, r image.Rectangle) string {
+	i, err := NewImage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := i.decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			dst.Set(x, y, src.At(r.Min.X+x, r.Min.Y+y))
+		}
+	}
+
+	fd, err := os.CreateTemp("", "imgdd-*.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	if err := jpeg.Encode(fd, dst, &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	return fd.Name()
+}
+
+func TestThumbnail(t *testing.T) {
+	// stored on its side, so the thumbnail has to come out upright
+	path := writeTransformed(t, tstImageOrig, OrientationTransform(6).Inverse(), 6)
+	defer os.Remove(path)
+
+	for _, tst := range []struct {
+		path string
+		size int
+		w, h int
+	}{
+		{tstImageOrig, 256, 256, 192},
+		{path, 256, 256, 192},
+		{tstImageOrig, 4000, tstImageWidth, tstImageHeight},
+	} {
+		i, err := NewImage(tst.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		thumb, err := i.Thumbnail(tst.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := thumb.Bounds(); b.Dx() != tst.w || b.Dy() != tst.h {
+			t.Errorf("thumbnail size mismatch - want: %dx%d, got: %dx%d", tst.w, tst.h, b.Dx(), b.Dy())
+		}
+	}
+}
+
+func TestDateFromName(t *testing.T) {
+	for _, tst := range []struct {
+		name string
+		want time.Time
+	}{
+		{"IMG_20190312_143015.jpg", time.Date(2019, 3, 12, 14, 30, 15, 0, time.Local)},
+		{"PXL_20190312_143015123.jpg", time.Date(2019, 3, 12, 14, 30, 15, 0, time.Local)},
+		{"Screenshot 2019-03-12 at 14.30.15.png", time.Date(2019, 3, 12, 0, 0, 0, 0, time.Local)},
+		{"Screenshot_2019-03-12-14-30-15.png", time.Date(2019, 3, 12, 14, 30, 15, 0, time.Local)},
+		{"2019.03.12.jpg", time.Date(2019, 3, 12, 0, 0, 0, 0, time.Local)},
+		{"IMG_20191332_000000.jpg", time.Time{}},
+		{"20190230.jpg", time.Time{}},
+		{"monkey.orig.jpg", time.Time{}},
+	} {
+		if got := dateFromName(tst.name); !got.Equal(tst.want) {
+			t.Errorf("date of %s - want: %s, got: %s", tst.name, tst.want, got)
+		}
+	}
+}
+
+func TestDateTaken(t *testing.T) {
+	dir, err := os.MkdirTemp("", "imgdd-img-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "IMG_20190312_143015.png")
+	if err := os.WriteFile(path, []byte("not an image"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tst := range []struct {
+		sources []string
+		want    time.Time
+		source  string
+	}{
+		{DateSources, time.Date(2019, 3, 12, 14, 30, 15, 0, time.Local), DateFileName},
+		{[]string{DateExifOriginal, DateModTime, DateFileName}, mtime, DateModTime},
+		{[]string{DateExifOriginal, DateGPS}, time.Time{}, ""},
+	} {
+		got, source, err := DateTaken(path, tst.sources)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(tst.want) || source != tst.source {
+			t.Errorf("date of %v - want: %s from %q, got: %s from %q", tst.sources, tst.want, tst.source, got, source)
+		}
+	}
+
+	if _, err := ParseDateSources("exif-original,nope"); err == nil {
+		t.Errorf("unknown date source - want: error, got: nil")
+	}
+}
+
+// writeRAW writes a little endian TIFF container like a CR2: IFD0 holds the first JPEG as a
+// single old-style JPEG strip, IFD1 the second through the JPEGInterchangeFormat tags
+func writeRAW(t *testing.T, path string, full, thumb []byte) {
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	entry := func(tag, typ uint16, count, value uint32) {
+		binary.Write(&buf, le, tag)
+		binary.Write(&buf, le, typ)
+		binary.Write(&buf, le, count)
+		binary.Write(&buf, le, value)
+	}
+
+	// the header of a CR2 file, with the marker and the offset of the raw IFD after the TIFF one
+	const ifd0, ifd1 = 16, 16 + 2 + 3*12 + 4
+	data := uint32(ifd1 + 2 + 2*12 + 4)
+	buf.WriteString("II*\x00")
+	binary.Write(&buf, le, uint32(ifd0))
+	buf.WriteString("CR\x02\x00")
+	binary.Write(&buf, le, uint32(0))
+
+	binary.Write(&buf, le, uint16(3))
+	entry(0x0103, 3, 1, 6)
+	entry(0x0111, 4, 1, data)
+	entry(0x0117, 4, 1, uint32(len(full)))
+	binary.Write(&buf, le, uint32(ifd1))
+
+	binary.Write(&buf, le, uint16(2))
+	entry(0x0201, 4, 1, data+uint32(len(full)))
+	entry(0x0202, 4, 1, uint32(len(thumb)))
+	binary.Write(&buf, le, uint32(0))
+
+	buf.Write(full)
+	buf.Write(thumb)
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRAW(t *testing.T) {
+	dir, err := os.MkdirTemp("", "imgdd-img-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	full, err := os.ReadFile(tstImageOrig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var thumb bytes.Buffer
+	if err := jpeg.Encode(&thumb, image.NewGray(image.Rect(0, 0, 16, 12)), nil); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "monkey.CR2")
+	writeRAW(t, path, full, thumb.Bytes())
+
+	raw, err := NewImage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw.Config.Width != tstImageWidth || raw.Config.Height != tstImageHeight {
+		t.Errorf("preview size mismatch - want: %dx%d, got: %dx%d", tstImageWidth, tstImageHeight, raw.Config.Width, raw.Config.Height)
+	}
+
+	orig, err := NewImage(tstImageOrig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := orig.FingerPrint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := raw.FingerPrint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Errorf("raw fingerprint mismatch - want: %x, got: %x", want, got)
+	}
+
+	if !SameShot(path, filepath.Join(dir, "monkey.jpg")) || SameShot(path, filepath.Join(dir, "other.jpg")) {
+		t.Errorf("same shot mismatch for %s", path)
+	}
+
+	// a CR2 without its extension is still decoded by its preview
+	bare := filepath.Join(dir, "IMG_0001")
+	writeRAW(t, bare, full, thumb.Bytes())
+	if got := Pages(bare); !reflect.DeepEqual(got, []string{bare}) {
+		t.Errorf("pages of a raw file mismatch - want: %s, got: %s", bare, got)
+	}
+	if i, err := NewImage(bare); err != nil {
+		t.Error(err)
+	} else if i.Config.Width != tstImageWidth || i.Config.Height != tstImageHeight {
+		t.Errorf("extensionless preview size mismatch - want: %dx%d, got: %dx%d", tstImageWidth, tstImageHeight, i.Config.Width, i.Config.Height)
+	}
+
+	bad := filepath.Join(dir, "bad.nef")
+	if err := os.WriteFile(bad, []byte("II*\x00\x08\x00\x00\x00\x00\x00"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewImage(bad); err == nil {
+		t.Errorf("raw without preview - want: error, got: nil")
+	}
+}
+
+// writeTIFF writes an uncompressed little endian TIFF with one 4x4 gray page per value
+func writeTIFF(t *testing.T, path string, values ...byte) {
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	entry := func(tag, typ uint16, count, value uint32) {
+		binary.Write(&buf, le, tag)
+		binary.Write(&buf, le, typ)
+		binary.Write(&buf, le, count)
+		binary.Write(&buf, le, value)
+	}
+
+	const entries, pixels = 8, 16
+	const ifdSize = 2 + entries*12 + 4
+	buf.WriteString("II*\x00")
+	binary.Write(&buf, le, uint32(8))
+	for j, v := range values {
+		ifd := uint32(8 + j*(ifdSize+pixels))
+		next := uint32(0)
+		if j < len(values)-1 {
+			next = ifd + ifdSize + pixels
+		}
+		binary.Write(&buf, le, uint16(entries))
+		entry(256, 3, 1, 4)
+		entry(257, 3, 1, 4)
+		entry(258, 3, 1, 8)
+		entry(259, 3, 1, 1)
+		entry(262, 3, 1, 1)
+		entry(273, 4, 1, ifd+ifdSize)
+		entry(278, 3, 1, 4)
+		entry(279, 4, 1, pixels)
+		binary.Write(&buf, le, next)
+		buf.Write(bytes.Repeat([]byte{v}, pixels))
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPages(t *testing.T) {
+	dir, err := os.MkdirTemp("", "imgdd-img-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	single := filepath.Join(dir, "single.tif")
+	writeTIFF(t, single, 0x10)
+	if got := Pages(single); !reflect.DeepEqual(got, []string{single}) {
+		t.Errorf("pages of a single page tiff mismatch - want: %s, got: %s", single, got)
+	}
+
+	multi := filepath.Join(dir, "multi.tiff")
+	writeTIFF(t, multi, 0x10, 0xf0)
+	want := []string{multi + "#page=1", multi + "#page=2"}
+	got := Pages(multi)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("pages mismatch - want: %s, got: %s", want, got)
+	}
+
+	var fps [][]byte
+	for j, name := range got {
+		if file, page := SplitPage(name); file != multi || page != j+1 {
+			t.Errorf("split %s mismatch - got: %s, %d", name, file, page)
+		}
+		i, err := NewImage(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src, err := i.decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r, _, _, _ := src.At(1, 1).RGBA(); r>>8 != uint32([]byte{0x10, 0xf0}[j]) {
+			t.Errorf("pixel of %s mismatch - got: %x", name, r>>8)
+		}
+		fp, err := i.FingerPrint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fps = append(fps, fp)
+	}
+	if bytes.Equal(fps[0], fps[1]) {
+		t.Errorf("pages of different content got the same fingerprint")
+	}
+
+	// the pages of a TIFF are found by its content, not its name
+	dat := filepath.Join(dir, "scan.dat")
+	writeTIFF(t, dat, 0x10, 0xf0)
+	if got := Pages(dat); len(got) != 2 || got[1] != dat+"#page=2" {
+		t.Errorf("pages of a misnamed tiff mismatch - want: 2 pages, got: %s", got)
+	}
+
+	if _, err := NewImage(multi + "#page=3"); err == nil {
+		t.Errorf("missing page - want: error, got: nil")
+	}
+	if file, page := SplitPage("a#page=x.jpg"); file != "a#page=x.jpg" || page != 0 {
+		t.Errorf("split of a plain name mismatch - got: %s, %d", file, page)
+	}
+}
+
+func TestBMP(t *testing.T) {
+	dir, err := os.MkdirTemp("", "imgdd-img-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "scan.bmp")
+	fd, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bmp.Encode(fd, image.NewGray(image.Rect(0, 0, 8, 6)))
+	fd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := NewImage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Type != "bmp" || i.Config.Width != 8 || i.Config.Height != 6 {
+		t.Errorf("bmp mismatch - got: %s %dx%d", i.Type, i.Config.Width, i.Config.Height)
+	}
+	if got := ContentMatch.Match(path); got != "bmp" {
+		t.Errorf("bmp content mismatch - want: bmp, got: %s", got)
+	}
+	if _, err := i.FingerPrint(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWebP(t *testing.T) {
+	path := filepath.Join(tstImagePath, "gopher.webp")
+	i, err := NewImage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Type != "webp" || i.Config.Width == 0 || i.Config.Height == 0 {
+		t.Errorf("webp mismatch - got: %s %dx%d", i.Type, i.Config.Width, i.Config.Height)
+	}
+	if _, err := i.FingerPrint(); err != nil {
+		t.Error(err)
+	}
+
+	if ok, err := filepath.Match(WebPMatch.Patterns()[0], filepath.Base(path)); err != nil || !ok {
+		t.Errorf("webp pattern mismatch - want: match, got: %v (%v)", WebPMatch.Patterns(), err)
+	}
+	if got := ContentMatch.Match(path); got != "webp" {
+		t.Errorf("webp content mismatch - want: webp, got: %s", got)
+	}
+}
+
+func TestSniff(t *testing.T) {
+	tests := []struct {
+		path string
+		head string
+		want string
+	}{
+		{"a.jpe", "\xff\xd8\xff\xe0\x00\x10JFIF", "jpeg"},
+		{"a", "\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR", "png"},
+		{"a.gif", "GIF89a\x01\x00", "gif"},
+		{"a.jfif", "RIFF\x10\x00\x00\x00WEBPVP8 ", "webp"},
+		{"a.bmp", "BM\x36\x00\x00\x00\x00\x00\x00\x00\x36\x00\x00\x00\x28\x00\x00\x00", "bmp"},
+		{"a.bmp", "BM\x36\x00\x00\x00\x00\x00\x00\x00\x36\x00\x00\x00\x29\x00\x00\x00", ""},
+		{"a.bmp", "BM\x36\x00\x00\x00", ""},
+		{"a.txt", "BMW is a car maker from Munich", ""},
+		{"a.tif", "II*\x00\x08\x00\x00\x00", "tiff"},
+		{"a.nef", "MM\x00*\x00\x00\x00\x08", "nef"},
+		{"a.tif", "II*\x00\x10\x00\x00\x00CR\x02\x00", "cr2"},
+		{"a.jpg", "not really an image", ""},
+		{"a.jpg", "\xff", ""},
+		{"a.wav", "RIFF\x10\x00\x00\x00WAVEfmt ", ""},
+	}
+	for _, tst := range tests {
+		if got := Sniff(tst.path, []byte(tst.head)); got != tst.want {
+			t.Errorf("format of %s %q mismatch - want: %q, got: %q", tst.path, tst.head, tst.want, got)
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "imgdd-img-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	misnamed := filepath.Join(dir, "notes.jpg")
+	if err := os.WriteFile(misnamed, []byte("not really an image"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := ContentMatch.Match(misnamed); got != "" {
+		t.Errorf("text named like a jpeg matched as %s", got)
+	}
+	if got := ContentMatch.Match(tstImageOrig); got != "jpeg" {
+		t.Errorf("jpeg format mismatch - want: jpeg, got: %s", got)
+	}
+}
+
+// recompress writes a copy of the image at path encoded as a JPEG of the given quality
+func recompress(t *testing.T, path string, quality int) string {
+	i, err := NewImage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := i.decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := os.CreateTemp("", "imgdd-*.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	if err := jpeg.Encode(fd, src, &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatal(err)
+	}
+	return fd.Name()
+}
+
+func TestDihedralRecompressed(t *testing.T) {
+	orig, err := NewImage(tstImageShrink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fper, err := NewFingerPrinter(AlgoPHash+DihedralSuffix, orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origFp, origT, err := fper.(CanonicalFingerPrinter).Canonical()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// recompressing flips bits of the hashes of some orientations, which must not change the
+	// orientation the fingerprint is taken in
+	for _, tr := range []Transform{Rotate90, Rotate180, FlipH} {
+		rotated := writeTransformed(t, tstImageShrink, tr, 0)
+		defer os.Remove(rotated)
+		path := recompress(t, rotated, 5)
+		defer os.Remove(path)
+
+		i, err := NewImage(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fper, err := NewFingerPrinter(AlgoPHash+DihedralSuffix, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fp, fpT, err := fper.(CanonicalFingerPrinter).Canonical()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if d := Distance(origFp, fp); d != 0 {
+			t.Errorf("%s recompressed copy not matched - want: distance 0, got: %d", tr, d)
+		}
+		if got := origT.Then(fpT.Inverse()); got != tr {
+			t.Errorf("detected transform mismatch - want: %s, got: %s", tr, got)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package img
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"math/bits"
+	"sort"
+)
+
+// AlgoKeyPoints fingerprints an image with its perceptual hash plus hashes of the patches around
+// its corners, which survive cropping
+const AlgoKeyPoints = "keypoints"
+
+const (
+	// keyPointScale is how many source pixels make up one pixel of the image corners are searched in
+	keyPointScale = 4
+	// keyPointMax is the maximum number of keypoints kept per image
+	keyPointMax = 1024
+	// patchRadius is half the size of the patch hashed around a keypoint, in scaled pixels
+	patchRadius = 8
+	// suppressRadius is how far a corner must dominate its neighbours to become a keypoint
+	suppressRadius = 6
+
+	// keyPointDistance is the maximum number of differing bits for two patches to match
+	keyPointDistance = 10
+	// minInliers is how many keypoints must agree on an offset for an image to be contained in another
+	minInliers = 8
+	// offsetTolerance is how far, in source pixels, a match may stray from the agreed offset
+	offsetTolerance = 2 * keyPointScale
+)
+
+// KeyPoint is a corner of an image and the hash of the patch around it
+type KeyPoint struct {
+	X, Y int
+	Hash uint64
+}
+
+// KeyPointSet is the keypoints of an image and its size
+type KeyPointSet struct {
+	Width, Height int
+	Points        []KeyPoint
+}
+
+// KeyPointFingerPrinter is a FingerPrinter that also describes the keypoints of an image
+type KeyPointFingerPrinter interface {
+	FingerPrinter
+
+	// FingerPrintKeyPoints returns the fingerprint and the keypoints of the image
+	FingerPrintKeyPoints() ([]byte, *KeyPointSet, error)
+}
+
+// KeyPoints fingerprints an image with its perceptual hash and finds its keypoints. Keypoints are
+// located in source pixels, so crops are only found when they were saved at the original scale.
+type KeyPoints struct {
+	*Image
+}
+
+// FingerPrint returns the 64-bit perceptual hash of the image
+func (k *KeyPoints) FingerPrint() ([]byte, error) {
+	fp, _, err := k.FingerPrintKeyPoints()
+	return fp, err
+}
+
+// FingerPrintKeyPoints returns the 64-bit perceptual hash and the keypoints of the image
+func (k *KeyPoints) FingerPrintKeyPoints() ([]byte, *KeyPointSet, error) {
+	src, err := k.decode()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fp := hashBytes(pHash(newGrid(src, gridSize, gridSize)))
+	b := src.Bounds()
+	return fp, &KeyPointSet{
+		Width:  b.Dx(),
+		Height: b.Dy(),
+		Points: keyPoints(shrink(src, keyPointScale)),
+	}, nil
+}
+
+// shrink averages every factor x factor block of source pixels into one cell, dropping partial
+// blocks at the right and bottom edge so cells line up with absolute pixel positions
+func shrink(src image.Image, factor int) *grid {
+	b := src.Bounds()
+	w, h := b.Dx()/factor, b.Dy()/factor
+	g := &grid{w: w, h: h, px: make([]float64, w*h)}
+	for y := 0; y < h*factor; y++ {
+		for x := 0; x < w*factor; x++ {
+			g.px[(y/factor)*w+x/factor] += luminance(src, b.Min.X+x, b.Min.Y+y)
+		}
+	}
+	for j := range g.px {
+		g.px[j] /= float64(factor * factor)
+	}
+	return g
+}
+
+// keyPoints finds the strongest Harris corners of a grid and hashes the patch around each
+func keyPoints(g *grid) []KeyPoint {
+	if g.w < 2*patchRadius+2 || g.h < 2*patchRadius+2 {
+		return nil
+	}
+
+	// structure tensor of the gradients, summed over a 5x5 window
+	ixx := make([]float64, len(g.px))
+	iyy := make([]float64, len(g.px))
+	ixy := make([]float64, len(g.px))
+	for y := 1; y < g.h-1; y++ {
+		for x := 1; x < g.w-1; x++ {
+			dx := (g.at(x+1, y) - g.at(x-1, y)) / 2
+			dy := (g.at(x, y+1) - g.at(x, y-1)) / 2
+			ixx[y*g.w+x], iyy[y*g.w+x], ixy[y*g.w+x] = dx*dx, dy*dy, dx*dy
+		}
+	}
+
+	response := make([]float64, len(g.px))
+	for y := 3; y < g.h-3; y++ {
+		for x := 3; x < g.w-3; x++ {
+			var sxx, syy, sxy float64
+			for wy := y - 2; wy <= y+2; wy++ {
+				for wx := x - 2; wx <= x+2; wx++ {
+					sxx += ixx[wy*g.w+wx]
+					syy += iyy[wy*g.w+wx]
+					sxy += ixy[wy*g.w+wx]
+				}
+			}
+			response[y*g.w+x] = sxx*syy - sxy*sxy - 0.04*(sxx+syy)*(sxx+syy)
+		}
+	}
+
+	type corner struct {
+		x, y int
+		r    float64
+	}
+	var corners []corner
+	for y := patchRadius; y < g.h-patchRadius; y++ {
+		for x := patchRadius; x < g.w-patchRadius; x++ {
+			r := response[y*g.w+x]
+			if r <= 0 || !isLocalMax(response, g.w, g.h, x, y) {
+				continue
+			}
+			corners = append(corners, corner{x, y, r})
+		}
+	}
+	sort.Slice(corners, func(a, b int) bool {
+		return corners[a].r > corners[b].r
+	})
+	if len(corners) > keyPointMax {
+		corners = corners[:keyPointMax]
+	}
+
+	res := make([]KeyPoint, 0, len(corners))
+	for _, c := range corners {
+		patch := &grid{w: 2 * patchRadius, h: 2 * patchRadius, px: make([]float64, 4*patchRadius*patchRadius)}
+		for py := 0; py < patch.h; py++ {
+			for px := 0; px < patch.w; px++ {
+				patch.px[py*patch.w+px] = g.at(c.x-patchRadius+px, c.y-patchRadius+py)
+			}
+		}
+		res = append(res, KeyPoint{
+			X:    c.x*keyPointScale + keyPointScale/2,
+			Y:    c.y*keyPointScale + keyPointScale/2,
+			Hash: dHash(patch),
+		})
+	}
+	return res
+}
+
+// isLocalMax reports whether the response at x, y is the largest within suppressRadius
+func isLocalMax(response []float64, w, h, x, y int) bool {
+	r := response[y*w+x]
+	for ny := y - suppressRadius; ny <= y+suppressRadius; ny++ {
+		for nx := x - suppressRadius; nx <= x+suppressRadius; nx++ {
+			if nx < 0 || ny < 0 || nx >= w || ny >= h || (nx == x && ny == y) {
+				continue
+			}
+			if n := response[ny*w+nx]; n > r || (n == r && ny*w+nx < y*w+x) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Containment is where an image was found inside another one
+type Containment struct {
+	// DX and DY are the position of the contained image within the containing one
+	DX, DY int
+	// Overlap is the share of the containing image that the contained one covers
+	Overlap float64
+	// Matches is the number of keypoints that agree on the position
+	Matches int
+}
+
+// ContainedIn reports whether the image described by s is a crop of the image described by o
+func (s *KeyPointSet) ContainedIn(o *KeyPointSet) (Containment, bool) {
+	if s.Width*s.Height >= o.Width*o.Height {
+		return Containment{}, false
+	}
+
+	type offset struct{ dx, dy int }
+	var offsets []offset
+	for _, a := range s.Points {
+		best, bestD := -1, keyPointDistance+1
+		for j, b := range o.Points {
+			if d := bits.OnesCount64(a.Hash ^ b.Hash); d < bestD {
+				best, bestD = j, d
+			}
+		}
+		if best >= 0 {
+			offsets = append(offsets, offset{o.Points[best].X - a.X, o.Points[best].Y - a.Y})
+		}
+	}
+	if len(offsets) < minInliers {
+		return Containment{}, false
+	}
+
+	// the offset most matches agree on is where the crop was taken from
+	var res Containment
+	for _, c := range offsets {
+		var n, sx, sy int
+		for _, m := range offsets {
+			if abs(m.dx-c.dx) <= offsetTolerance && abs(m.dy-c.dy) <= offsetTolerance {
+				n++
+				sx += m.dx
+				sy += m.dy
+			}
+		}
+		if n > res.Matches {
+			res = Containment{DX: sx / n, DY: sy / n, Matches: n}
+		}
+	}
+	if res.Matches < minInliers {
+		return Containment{}, false
+	}
+
+	// the crop has to lie within the image it was taken from
+	if res.DX < -offsetTolerance || res.DY < -offsetTolerance ||
+		res.DX+s.Width > o.Width+offsetTolerance || res.DY+s.Height > o.Height+offsetTolerance {
+		return Containment{}, false
+	}
+
+	w := overlap(res.DX, s.Width, o.Width)
+	h := overlap(res.DY, s.Height, o.Height)
+	res.Overlap = float64(w*h) / float64(o.Width*o.Height)
+	return res, true
+}
+
+// overlap returns how much of the range 0-outer a range of length inner starting at off covers
+func overlap(off, inner, outer int) int {
+	lo, hi := off, off+inner
+	if lo < 0 {
+		lo = 0
+	}
+	if hi > outer {
+		hi = outer
+	}
+	return hi - lo
+}
+
+// abs returns the absolute value of an int
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// EncodeKeyPoints serializes a set of keypoints for storage
+func EncodeKeyPoints(s *KeyPointSet) []byte {
+	buf := make([]byte, 8+16*len(s.Points))
+	binary.BigEndian.PutUint32(buf[0:], uint32(s.Width))
+	binary.BigEndian.PutUint32(buf[4:], uint32(s.Height))
+	for j, p := range s.Points {
+		off := 8 + 16*j
+		binary.BigEndian.PutUint32(buf[off:], uint32(p.X))
+		binary.BigEndian.PutUint32(buf[off+4:], uint32(p.Y))
+		binary.BigEndian.PutUint64(buf[off+8:], p.Hash)
+	}
+	return buf
+}
+
+// DecodeKeyPoints deserializes a set of keypoints written by EncodeKeyPoints
+func DecodeKeyPoints(buf []byte) (*KeyPointSet, error) {
+	if len(buf) < 8 || (len(buf)-8)%16 != 0 {
+		return nil, fmt.Errorf("invalid keypoint data length: %d", len(buf))
+	}
+	s := &KeyPointSet{
+		Width:  int(binary.BigEndian.Uint32(buf[0:])),
+		Height: int(binary.BigEndian.Uint32(buf[4:])),
+		Points: make([]KeyPoint, (len(buf)-8)/16),
+	}
+	for j := range s.Points {
+		off := 8 + 16*j
+		s.Points[j] = KeyPoint{
+			X:    int(binary.BigEndian.Uint32(buf[off:])),
+			Y:    int(binary.BigEndian.Uint32(buf[off+4:])),
+			Hash: binary.BigEndian.Uint64(buf[off+8:]),
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,408 @@
+package img
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"math"
+	"math/bits"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Names of the fingerprint algorithms understood by NewFingerPrinter
+const (
+	// AlgoSHA256 is the exact fingerprint of the middle row and column of pixels
+	AlgoSHA256 = "sha256"
+	// AlgoDHash is the 64-bit difference (gradient) hash
+	AlgoDHash = "dhash"
+	// AlgoAHash is the 64-bit average hash
+	AlgoAHash = "ahash"
+	// AlgoPHash is the 64-bit DCT based perceptual hash
+	AlgoPHash = "phash"
+
+	// DihedralSuffix turns a perceptual algorithm into its rotation and mirror invariant form
+	DihedralSuffix = "-dihedral"
+)
+
+// Algorithms is the list of fingerprint algorithms that can be used with NewFingerPrinter
+var Algorithms = []string{
+	AlgoSHA256, AlgoDHash, AlgoAHash, AlgoPHash,
+	AlgoDHash + DihedralSuffix, AlgoAHash + DihedralSuffix, AlgoPHash + DihedralSuffix,
+	AlgoKeyPoints,
+}
+
+// CanonicalFingerPrinter is a FingerPrinter whose fingerprint does not change when the image is
+// rotated or mirrored
+type CanonicalFingerPrinter interface {
+	FingerPrinter
+
+	// Canonical returns the fingerprint and the transform that takes the image to the
+	// orientation the fingerprint was computed from
+	Canonical() ([]byte, Transform, error)
+}
+
+// gridSize is the size of the grayscale grid every perceptual hash is derived from
+const gridSize = 32
+
+// hashSize is the width and height of the bit matrix of a perceptual hash (8x8 = 64 bits)
+const hashSize = 8
+
+// NewFingerPrinter returns the FingerPrinter implementing the named algorithm for an image
+func NewFingerPrinter(algo string, i *Image) (FingerPrinter, error) {
+	switch algo {
+	case AlgoSHA256, "":
+		return i, nil
+	case AlgoDHash:
+		return &DHash{i}, nil
+	case AlgoAHash:
+		return &AHash{i}, nil
+	case AlgoPHash:
+		return &PHash{i}, nil
+	case AlgoDHash + DihedralSuffix:
+		return &Dihedral{i, dHash}, nil
+	case AlgoAHash + DihedralSuffix:
+		return &Dihedral{i, aHash}, nil
+	case AlgoPHash + DihedralSuffix:
+		return &Dihedral{i, pHash}, nil
+	case AlgoKeyPoints:
+		return &KeyPoints{i}, nil
+	}
+	return nil, fmt.Errorf("unknown fingerprint algorithm: %s", algo)
+}
+
+// DHash fingerprints an image by the brightness gradient between neighbouring cells
+type DHash struct {
+	*Image
+}
+
+// FingerPrint returns the 64-bit difference hash of the image
+func (d *DHash) FingerPrint() ([]byte, error) {
+	g, err := d.grayGrid()
+	if err != nil {
+		return nil, err
+	}
+	return hashBytes(dHash(g)), nil
+}
+
+// AHash fingerprints an image by comparing cells to the mean brightness
+type AHash struct {
+	*Image
+}
+
+// FingerPrint returns the 64-bit average hash of the image
+func (a *AHash) FingerPrint() ([]byte, error) {
+	g, err := a.grayGrid()
+	if err != nil {
+		return nil, err
+	}
+	return hashBytes(aHash(g)), nil
+}
+
+// PHash fingerprints an image by the low frequencies of its discrete cosine transform
+type PHash struct {
+	*Image
+}
+
+// FingerPrint returns the 64-bit perceptual hash of the image
+func (p *PHash) FingerPrint() ([]byte, error) {
+	g, err := p.grayGrid()
+	if err != nil {
+		return nil, err
+	}
+	return hashBytes(pHash(g)), nil
+}
+
+// Dihedral fingerprints an image with a perceptual hash of the one of its 8 rotations and
+// mirrorings that puts its brightness where the canonical orientation wants it, so every rotated
+// or mirrored copy is hashed in the same orientation. The orientation is chosen from the pixels
+// rather than from the hashes, since a recompressed copy may hash a bit differently.
+type Dihedral struct {
+	*Image
+	hash func(*grid) uint64
+}
+
+// FingerPrint returns the canonical 64-bit hash of the image
+func (d *Dihedral) FingerPrint() ([]byte, error) {
+	fp, _, err := d.Canonical()
+	return fp, err
+}
+
+// Canonical returns the canonical 64-bit hash of the image and the transform it was computed
+// from: the one that moves the brightness centroid furthest right, then furthest down. Images
+// whose centroid does not tell the transforms apart, such as symmetric ones, use the lowest hash.
+func (d *Dihedral) Canonical() ([]byte, Transform, error) {
+	g, err := d.grayGrid()
+	if err != nil {
+		return nil, Identity, err
+	}
+
+	var best uint64
+	var bestT Transform
+	var bestX, bestY float64
+	for _, t := range Transforms {
+		tg := g.transform(t)
+		x, y := tg.centroid()
+		h := d.hash(tg)
+		if t == Identity || canonicalBefore(x, y, h, bestX, bestY, best) {
+			best, bestT, bestX, bestY = h, t, x, y
+		}
+	}
+	return hashBytes(best), bestT, nil
+}
+
+// centroidEpsilon is the difference below which two centroid coordinates are the same
+const centroidEpsilon = 1e-6
+
+// canonicalBefore reports whether an orientation with centroid x, y and hash h is preferred to
+// one with centroid bx, by and hash bh
+func canonicalBefore(x, y float64, h uint64, bx, by float64, bh uint64) bool {
+	switch {
+	case x > bx+centroidEpsilon:
+		return true
+	case x < bx-centroidEpsilon:
+		return false
+	case y > by+centroidEpsilon:
+		return true
+	case y < by-centroidEpsilon:
+		return false
+	}
+	return h < bh
+}
+
+// grayGrid decodes the image and shrinks it to a gridSize x gridSize grayscale grid
+func (i *Image) grayGrid() (*grid, error) {
+	log.Debugf("fingerprinting %s", i.Path)
+	src, err := i.decode()
+	if err != nil {
+		return nil, err
+	}
+	return newGrid(src, gridSize, gridSize), nil
+}
+
+// hashBytes returns the big endian bytes of a 64-bit hash
+func hashBytes(h uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, h)
+	return buf
+}
+
+// dHash sets a bit for every cell that is brighter than its right hand neighbour
+func dHash(g *grid) uint64 {
+	s := g.resize(hashSize+1, hashSize)
+	var h uint64
+	for y := 0; y < s.h; y++ {
+		for x := 0; x < s.w-1; x++ {
+			h <<= 1
+			if s.at(x, y) > s.at(x+1, y) {
+				h |= 1
+			}
+		}
+	}
+	return h
+}
+
+// aHash sets a bit for every cell that is brighter than the mean of all cells
+func aHash(g *grid) uint64 {
+	s := g.resize(hashSize, hashSize)
+	var mean float64
+	for _, v := range s.px {
+		mean += v
+	}
+	mean /= float64(len(s.px))
+
+	var h uint64
+	for _, v := range s.px {
+		h <<= 1
+		if v > mean {
+			h |= 1
+		}
+	}
+	return h
+}
+
+// pHash sets a bit for every low frequency DCT coefficient above the median coefficient
+func pHash(g *grid) uint64 {
+	coef := dct2(g)
+
+	low := make([]float64, 0, hashSize*hashSize)
+	for y := 0; y < hashSize; y++ {
+		for x := 0; x < hashSize; x++ {
+			low = append(low, coef[y*g.w+x])
+		}
+	}
+
+	// the DC coefficient is the mean brightness and would skew the median
+	sorted := make([]float64, len(low)-1)
+	copy(sorted, low[1:])
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	var h uint64
+	for _, v := range low {
+		h <<= 1
+		if v > median {
+			h |= 1
+		}
+	}
+	return h
+}
+
+// dct2 returns the 2D type II discrete cosine transform of a square grid
+func dct2(g *grid) []float64 {
+	n := g.w
+	cos := make([]float64, n*n)
+	for k := 0; k < n; k++ {
+		for x := 0; x < n; x++ {
+			cos[k*n+x] = math.Cos(math.Pi / float64(n) * (float64(x) + 0.5) * float64(k))
+		}
+	}
+
+	rows := make([]float64, n*n)
+	for y := 0; y < n; y++ {
+		for k := 0; k < n; k++ {
+			var sum float64
+			for x := 0; x < n; x++ {
+				sum += g.px[y*n+x] * cos[k*n+x]
+			}
+			rows[y*n+k] = sum
+		}
+	}
+
+	res := make([]float64, n*n)
+	for x := 0; x < n; x++ {
+		for k := 0; k < n; k++ {
+			var sum float64
+			for y := 0; y < n; y++ {
+				sum += rows[y*n+x] * cos[k*n+y]
+			}
+			res[k*n+x] = sum
+		}
+	}
+	return res
+}
+
+// grid is a small matrix of grayscale values
+type grid struct {
+	w, h int
+	px   []float64
+}
+
+// at returns the value of a cell
+func (g *grid) at(x, y int) float64 {
+	return g.px[y*g.w+x]
+}
+
+// newGrid shrinks an image to a w x h grid of luminance values by averaging the pixels under each cell
+func newGrid(src image.Image, w, h int) *grid {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	sum := make([]float64, w*h)
+	cnt := make([]float64, w*h)
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		cy := (y - b.Min.Y) * h / sh
+		for x := b.Min.X; x < b.Max.X; x++ {
+			cx := (x - b.Min.X) * w / sw
+			sum[cy*w+cx] += luminance(src, x, y)
+			cnt[cy*w+cx]++
+		}
+	}
+
+	for j := range sum {
+		if cnt[j] > 0 {
+			sum[j] /= cnt[j]
+		}
+	}
+	return &grid{w: w, h: h, px: sum}
+}
+
+// luminance returns the brightness of a pixel in the range 0-255
+func luminance(src image.Image, x, y int) float64 {
+	switch s := src.(type) {
+	case *image.YCbCr:
+		return float64(s.Y[s.YOffset(x, y)])
+	case *image.Gray:
+		return float64(s.Pix[s.PixOffset(x, y)])
+	case *oriented:
+		sx, sy := s.source(x, y)
+		return luminance(s.src, sx, sy)
+	}
+	r, g, b, _ := src.At(x, y).RGBA()
+	return (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+}
+
+// centroid returns the offset from the centre of the grid of the centroid of its brightness
+// above the mean, in cells. It moves with the image when it is rotated or mirrored and, being an
+// average over every cell, hardly at all when it is recompressed.
+func (g *grid) centroid() (float64, float64) {
+	var mean float64
+	for _, v := range g.px {
+		mean += v
+	}
+	mean /= float64(len(g.px))
+
+	cx, cy := float64(g.w-1)/2, float64(g.h-1)/2
+	var x, y float64
+	for j, v := range g.px {
+		x += (float64(j%g.w) - cx) * (v - mean)
+		y += (float64(j/g.w) - cy) * (v - mean)
+	}
+	n := float64(len(g.px))
+	return x / n, y / n
+}
+
+// resize resamples the grid to w x h cells, weighting each source cell by the area it covers
+func (g *grid) resize(w, h int) *grid {
+	xw := areaWeights(g.w, w)
+	yw := areaWeights(g.h, h)
+	res := &grid{w: w, h: h, px: make([]float64, w*h)}
+	for ty := 0; ty < h; ty++ {
+		for tx := 0; tx < w; tx++ {
+			var sum, total float64
+			for sy := 0; sy < g.h; sy++ {
+				if yw[ty][sy] == 0 {
+					continue
+				}
+				for sx := 0; sx < g.w; sx++ {
+					wt := yw[ty][sy] * xw[tx][sx]
+					sum += g.at(sx, sy) * wt
+					total += wt
+				}
+			}
+			res.px[ty*w+tx] = sum / total
+		}
+	}
+	return res
+}
+
+// areaWeights returns, for every target cell, how much of each source cell it covers
+func areaWeights(src, dst int) [][]float64 {
+	res := make([][]float64, dst)
+	scale := float64(src) / float64(dst)
+	for t := 0; t < dst; t++ {
+		res[t] = make([]float64, src)
+		lo, hi := float64(t)*scale, float64(t+1)*scale
+		for s := int(lo); s < src && float64(s) < hi; s++ {
+			res[t][s] = math.Min(hi, float64(s+1)) - math.Max(lo, float64(s))
+		}
+	}
+	return res
+}
+
+// Distance returns the number of bits that differ between two fingerprints
+func Distance(a, b []byte) int {
+	if len(a) < len(b) {
+		a, b = b, a
+	}
+	var d int
+	for j := range a {
+		if j < len(b) {
+			d += bits.OnesCount8(a[j] ^ b[j])
+		} else {
+			d += bits.OnesCount8(a[j])
+		}
+	}
+	return d
+}
@@ -0,0 +1,185 @@
+package img
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// rawExts are the extensions of the camera raw formats whose embedded JPEG previews are decoded
+// in place of their sensor data. All of them are TIFF containers.
+var rawExts = map[string]bool{
+	".cr2": true,
+	".nef": true,
+	".arw": true,
+	".dng": true,
+}
+
+// TIFF tags that lead to embedded JPEGs
+const (
+	tagCompression     = 0x0103
+	tagStripOffsets    = 0x0111
+	tagStripByteCounts = 0x0117
+	tagSubIFDs         = 0x014a
+	tagJPEGOffset      = 0x0201
+	tagJPEGLength      = 0x0202
+	tagExifIFD         = 0x8769
+)
+
+const (
+	// compressionOldJPEG and compressionJPEG mark strips that hold a JPEG stream
+	compressionOldJPEG = 6
+	compressionJPEG    = 7
+	// maxIFDs bounds the IFDs read from one file, so a corrupt file cannot make the walk loop
+	maxIFDs = 64
+	// maxIFDEntries bounds the entries of one IFD
+	maxIFDEntries = 1024
+)
+
+// IsRAW reports whether path names a camera raw file by its extension
+func IsRAW(path string) bool {
+	return rawExts[strings.ToLower(filepath.Ext(path))]
+}
+
+// SameShot reports whether a and b are a raw file and the JPEG the camera wrote next to it: the
+// same directory and base name, one of them raw and the other not
+func SameShot(a, b string) bool {
+	if IsRAW(a) == IsRAW(b) || filepath.Dir(a) != filepath.Dir(b) {
+		return false
+	}
+	stem := func(p string) string {
+		base := filepath.Base(p)
+		return strings.ToLower(strings.TrimSuffix(base, filepath.Ext(base)))
+	}
+	return stem(a) == stem(b)
+}
+
+// preview is the location of an embedded JPEG within a raw file
+type preview struct {
+	offset int64
+	length int64
+}
+
+// rawPreview finds the largest JPEG embedded in a TIFF based raw file by walking its IFDs, their
+// sub-IFDs and the EXIF IFD. JPEGs are found through the JPEGInterchangeFormat tags and through
+// single strips compressed as JPEG. Streams image/jpeg cannot decode, such as the lossless JPEG
+// raw data of DNG files, are passed over.
+func rawPreview(r io.ReaderAt, size int64) (preview, image.Config, error) {
+	var best preview
+	var bestCfg image.Config
+
+	order, first, err := tiffHeader(r)
+	if err != nil {
+		return best, bestCfg, fmt.Errorf("not a TIFF based raw file")
+	}
+
+	consider := func(offset, length int64) {
+		if offset <= 0 || length <= 2 || offset+length > size {
+			return
+		}
+		magic := make([]byte, 2)
+		if _, err := r.ReadAt(magic, offset); err != nil || !bytes.Equal(magic, []byte{0xff, 0xd8}) {
+			return
+		}
+		cfg, err := jpeg.DecodeConfig(io.NewSectionReader(r, offset, length))
+		if err != nil {
+			return
+		}
+		if cfg.Width*cfg.Height > bestCfg.Width*bestCfg.Height {
+			best, bestCfg = preview{offset, length}, cfg
+		}
+	}
+
+	queue := []int64{first}
+	seen := make(map[int64]bool)
+	for len(queue) > 0 && len(seen) < maxIFDs {
+		off := queue[0]
+		queue = queue[1:]
+		if off <= 0 || off >= size || seen[off] {
+			continue
+		}
+		seen[off] = true
+
+		d, next, err := readIFD(r, order, off)
+		if err != nil {
+			continue
+		}
+		queue = append(queue, next)
+		queue = append(queue, d[tagSubIFDs]...)
+		queue = append(queue, d[tagExifIFD]...)
+
+		if offs, lens := d[tagJPEGOffset], d[tagJPEGLength]; len(offs) == 1 && len(lens) == 1 {
+			consider(offs[0], lens[0])
+		}
+		if c := d[tagCompression]; len(c) == 1 && (c[0] == compressionOldJPEG || c[0] == compressionJPEG) {
+			if offs, lens := d[tagStripOffsets], d[tagStripByteCounts]; len(offs) == 1 && len(lens) == 1 {
+				consider(offs[0], lens[0])
+			}
+		}
+	}
+
+	if best.length == 0 {
+		return best, bestCfg, fmt.Errorf("no JPEG preview found")
+	}
+	return best, bestCfg, nil
+}
+
+// readIFD reads the integer valued entries of the IFD at off and the offset of the next IFD.
+// Entries of other types are left out.
+func readIFD(r io.ReaderAt, order binary.ByteOrder, off int64) (map[uint16][]int64, int64, error) {
+	buf := make([]byte, 2)
+	if _, err := r.ReadAt(buf, off); err != nil {
+		return nil, 0, err
+	}
+	n := int(order.Uint16(buf))
+	if n > maxIFDEntries {
+		return nil, 0, fmt.Errorf("IFD of %d entries", n)
+	}
+
+	buf = make([]byte, n*12+4)
+	if _, err := r.ReadAt(buf, off+2); err != nil {
+		return nil, 0, err
+	}
+
+	entries := make(map[uint16][]int64)
+	for j := 0; j < n; j++ {
+		e := buf[j*12 : j*12+12]
+		tag, typ, count := order.Uint16(e), order.Uint16(e[2:]), order.Uint32(e[4:])
+
+		var width int
+		switch typ {
+		case 3: // SHORT
+			width = 2
+		case 4, 13: // LONG, IFD
+			width = 4
+		default:
+			continue
+		}
+		if count == 0 || count > maxIFDEntries {
+			continue
+		}
+
+		data := e[8:12]
+		if int(count)*width > 4 {
+			data = make([]byte, int(count)*width)
+			if _, err := r.ReadAt(data, int64(order.Uint32(e[8:]))); err != nil {
+				continue
+			}
+		}
+		values := make([]int64, count)
+		for k := range values {
+			if width == 2 {
+				values[k] = int64(order.Uint16(data[k*2:]))
+			} else {
+				values[k] = int64(order.Uint32(data[k*4:]))
+			}
+		}
+		entries[tag] = values
+	}
+	return entries, int64(order.Uint32(buf[n*12:])), nil
+}
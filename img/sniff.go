@@ -0,0 +1,131 @@
+package img
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sniffLen is the number of bytes read from the start of a file to tell its format
+const sniffLen = 32
+
+// magics are the leading bytes of the formats the package decodes
+var magics = []struct {
+	format string
+	offset int
+	magic  []byte
+}{
+	{"jpeg", 0, []byte{0xff, 0xd8, 0xff}},
+	{"png", 0, []byte("\x89PNG\r\n\x1a\n")},
+	{"gif", 0, []byte("GIF87a")},
+	{"gif", 0, []byte("GIF89a")},
+	{"webp", 8, []byte("WEBP")},
+	{"bmp", 0, []byte("BM")},
+	{"tiff", 0, []byte("II*\x00")},
+	{"tiff", 0, []byte("MM\x00*")},
+}
+
+// SniffMatch matches the files whose first bytes are those of a format the package decodes,
+// whatever their name, so misnamed images are found and files merely named like images are not.
+// Its patterns, if any, narrow down the files it reads.
+type SniffMatch struct {
+	patterns []string
+}
+
+// NewSniffMatch creates a new SniffMatch that only reads the files matching patterns
+func NewSniffMatch(patterns []string) *SniffMatch {
+	return &SniffMatch{
+		patterns: patterns,
+	}
+}
+
+// ContentMatch matches every file that is an image by its content
+var ContentMatch = &SniffMatch{}
+
+// Patterns returns the patters for this Matcher
+func (s *SniffMatch) Patterns() []string {
+	return s.patterns
+}
+
+// Match returns the format of the image at path, or "" when it is not one
+func (s *SniffMatch) Match(path string) string {
+	fd, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer fd.Close()
+	return sniffFile(fd, path)
+}
+
+// sniffFile returns the format of the image read from r, as Sniff does for the file at path
+func sniffFile(r io.ReaderAt, path string) string {
+	head := make([]byte, sniffLen)
+	n, err := r.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return ""
+	}
+	return Sniff(path, head[:n])
+}
+
+// Sniff returns the format of an image from the first bytes of the file, or "" when they are not
+// those of a format the package decodes. Raw files are TIFF containers, so a TIFF named like a raw
+// file, or with the CR2 marker, is reported by its raw format.
+func Sniff(path string, head []byte) string {
+	for _, m := range magics {
+		if len(head) < m.offset+len(m.magic) || !bytes.Equal(head[m.offset:m.offset+len(m.magic)], m.magic) {
+			continue
+		}
+		if m.format == "webp" && !bytes.HasPrefix(head, []byte("RIFF")) {
+			continue
+		}
+		if m.format == "bmp" && !isBMPHeader(head) {
+			continue
+		}
+		if m.format == "tiff" {
+			if len(head) >= 11 && string(head[8:11]) == "CR\x02" {
+				return "cr2"
+			}
+			if IsRAW(path) {
+				return strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+			}
+		}
+		return m.format
+	}
+	return ""
+}
+
+// bmpHeaderSizes are the sizes of the DIB headers of the BMP versions, which follow the file header
+var bmpHeaderSizes = map[uint32]bool{12: true, 40: true, 52: true, 56: true, 64: true, 108: true, 124: true}
+
+// isBMPHeader reports whether head starts with a BMP file header: "BM" alone starts too many text
+// files, so the reserved bytes must be zero and a DIB header of a known size must follow.
+func isBMPHeader(head []byte) bool {
+	if len(head) < 18 || !bytes.Equal(head[6:10], []byte{0, 0, 0, 0}) {
+		return false
+	}
+	return bmpHeaderSizes[binary.LittleEndian.Uint32(head[14:18])]
+}
+
+// extFormats are the formats Sniff reports, by the extensions images of that format have
+var extFormats = map[string]string{
+	".jpg":  "jpeg",
+	".jpeg": "jpeg",
+	".png":  "png",
+	".gif":  "gif",
+	".webp": "webp",
+	".bmp":  "bmp",
+	".tif":  "tiff",
+	".tiff": "tiff",
+}
+
+// ExtFormat returns the format the extension of path names, in the terms of Sniff, or "" when it
+// names none the package decodes
+func ExtFormat(path string) string {
+	if IsRAW(path) {
+		return strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+	return extFormats[strings.ToLower(filepath.Ext(path))]
+}
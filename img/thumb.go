@@ -0,0 +1,55 @@
+package img
+
+import (
+	"image"
+	"os"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"golang.org/x/image/draw"
+)
+
+// Thumbnail returns the upright image scaled down to fit within size x size pixels. Images that
+// already fit are returned at their own size.
+func (i *Image) Thumbnail(size int) (image.Image, error) {
+	src, err := i.decode()
+	if err != nil {
+		return nil, err
+	}
+
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, h*size/w
+		} else {
+			w, h = w*size/h, size
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+	return dst, nil
+}
+
+// ExifDateTime returns the date and time the image was taken according to its EXIF data
+func (i *Image) ExifDateTime() (time.Time, error) {
+	file, _ := SplitPage(i.Path)
+	fd, err := os.Open(file)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer fd.Close()
+
+	x, err := exif.Decode(fd)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return x.DateTime()
+}
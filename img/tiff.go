@@ -0,0 +1,138 @@
+package img
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// pageSep separates the path of a multi-page TIFF from the page number in the name of a page
+const pageSep = "#page="
+
+// PageName returns the name under which a page of a multi-page TIFF is fingerprinted; pages are
+// numbered from 1
+func PageName(path string, page int) string {
+	return path + pageSep + strconv.Itoa(page)
+}
+
+// SplitPage splits a name made by PageName into the path of the file and the page number. Other
+// names are returned as they are with page 0.
+func SplitPage(name string) (string, int) {
+	j := strings.LastIndex(name, pageSep)
+	if j < 0 {
+		return name, 0
+	}
+	page, err := strconv.Atoi(name[j+len(pageSep):])
+	if err != nil || page < 1 {
+		return name, 0
+	}
+	return name[:j], page
+}
+
+// Pages returns the names to fingerprint a file under: the path itself, or a name made by
+// PageName for every page when the file is a TIFF of more than one page, whatever its name. Raw
+// files are TIFF containers too but are decoded by their preview, so they have a single name.
+func Pages(path string) []string {
+	fd, err := os.Open(path)
+	if err != nil {
+		return []string{path}
+	}
+	defer fd.Close()
+	if sniffFile(fd, path) != "tiff" {
+		return []string{path}
+	}
+	fi, err := fd.Stat()
+	if err != nil {
+		return []string{path}
+	}
+
+	ifds, err := tiffPages(fd, fi.Size())
+	if err != nil || len(ifds) < 2 {
+		return []string{path}
+	}
+	names := make([]string, len(ifds))
+	for j := range ifds {
+		names[j] = PageName(path, j+1)
+	}
+	return names
+}
+
+// tiffHeader reads the byte order and the offset of the first IFD of a TIFF file
+func tiffHeader(r io.ReaderAt) (binary.ByteOrder, int64, error) {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, 0, err
+	}
+	var order binary.ByteOrder
+	switch string(header[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, 0, fmt.Errorf("not a TIFF file")
+	}
+	if order.Uint16(header[2:]) != 42 {
+		return nil, 0, fmt.Errorf("not a TIFF file")
+	}
+	return order, int64(order.Uint32(header[4:])), nil
+}
+
+// tiffPages returns the offsets of the top level IFDs of a TIFF file, one per page
+func tiffPages(r io.ReaderAt, size int64) ([]int64, error) {
+	order, off, err := tiffHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	var res []int64
+	seen := make(map[int64]bool)
+	for off > 0 && off < size && !seen[off] && len(res) < maxIFDs {
+		seen[off] = true
+		_, next, err := readIFD(r, order, off)
+		if err != nil {
+			return res, err
+		}
+		res = append(res, off)
+		off = next
+	}
+	return res, nil
+}
+
+// pageReader reads a TIFF file as if the IFD of one of its pages came first, which is the only
+// page the tiff package decodes
+type pageReader struct {
+	r     io.ReaderAt
+	first []byte
+}
+
+// newPageReader returns a reader of the TIFF file r that starts at the given page, numbered from 1
+func newPageReader(r io.ReaderAt, size int64, page int) (*io.SectionReader, error) {
+	order, _, err := tiffHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	ifds, err := tiffPages(r, size)
+	if err != nil {
+		return nil, err
+	}
+	if page < 1 || page > len(ifds) {
+		return nil, fmt.Errorf("no page %d in a TIFF of %d pages", page, len(ifds))
+	}
+	first := make([]byte, 4)
+	order.PutUint32(first, uint32(ifds[page-1]))
+	return io.NewSectionReader(&pageReader{r: r, first: first}, 0, size), nil
+}
+
+// ReadAt implements io.ReaderAt, replacing the offset of the first IFD in the header
+func (p *pageReader) ReadAt(buf []byte, off int64) (int, error) {
+	n, err := p.r.ReadAt(buf, off)
+	for j := int64(0); j < int64(len(p.first)); j++ {
+		if k := 4 + j - off; k >= 0 && k < int64(n) {
+			buf[k] = p.first[j]
+		}
+	}
+	return n, err
+}
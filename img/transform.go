@@ -0,0 +1,166 @@
+package img
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// Transform is one of the 8 ways to rotate and mirror an image (the dihedral group of the square).
+// A Transform mirrors the image left to right first, when Mirrored, and then rotates it clockwise
+// by Rotation quarter turns.
+type Transform int
+
+// The 8 transforms of an image
+const (
+	Identity   Transform = iota // unchanged
+	Rotate90                    // rotated 90° clockwise
+	Rotate180                   // rotated 180°
+	Rotate270                   // rotated 90° counter-clockwise
+	FlipH                       // mirrored left to right
+	Transverse                  // mirrored along the anti-diagonal
+	FlipV                       // mirrored top to bottom
+	Transpose                   // mirrored along the main diagonal
+)
+
+// Transforms lists all transforms, starting with Identity
+var Transforms = []Transform{Identity, Rotate90, Rotate180, Rotate270, FlipH, Transverse, FlipV, Transpose}
+
+var transformNames = []string{
+	"unchanged",
+	"rotated 90° CW",
+	"rotated 180°",
+	"rotated 90° CCW",
+	"mirrored horizontally",
+	"mirrored along the anti-diagonal",
+	"mirrored vertically",
+	"mirrored along the main diagonal",
+}
+
+// Rotation returns the number of clockwise quarter turns of the transform
+func (t Transform) Rotation() int {
+	return int(t) % 4
+}
+
+// Mirrored returns whether the transform mirrors the image
+func (t Transform) Mirrored() bool {
+	return t >= FlipH
+}
+
+// newTransform returns the transform that mirrors (when m) and then rotates by r quarter turns
+func newTransform(r int, m bool) Transform {
+	r = ((r % 4) + 4) % 4
+	if m {
+		return Transform(r + 4)
+	}
+	return Transform(r)
+}
+
+// Then returns the transform that applies t and then u
+func (t Transform) Then(u Transform) Transform {
+	// mirroring reverses the direction of the rotations before it
+	r := t.Rotation()
+	if u.Mirrored() {
+		r = -r
+	}
+	return newTransform(r+u.Rotation(), t.Mirrored() != u.Mirrored())
+}
+
+// Inverse returns the transform that undoes t
+func (t Transform) Inverse() Transform {
+	if t.Mirrored() {
+		return t
+	}
+	return newTransform(-t.Rotation(), false)
+}
+
+// Swaps returns whether the transform swaps the width and height of an image
+func (t Transform) Swaps() bool {
+	return t.Rotation()%2 == 1
+}
+
+// Point returns where the pixel at x, y of a w x h image ends up after the transform
+func (t Transform) Point(x, y, w, h int) (int, int) {
+	if t.Mirrored() {
+		x = w - 1 - x
+	}
+	for r := 0; r < t.Rotation(); r++ {
+		x, y = h-1-y, x
+		w, h = h, w
+	}
+	return x, y
+}
+
+// String returns a description of the transform, e.g. "rotated 90° CW"
+func (t Transform) String() string {
+	if t < 0 || int(t) >= len(transformNames) {
+		return fmt.Sprintf("Transform(%d)", int(t))
+	}
+	return transformNames[t]
+}
+
+// orientationTransforms maps the EXIF orientations 1-8 to the transform that turns the stored
+// pixels upright
+var orientationTransforms = []Transform{Identity, Identity, FlipH, Rotate180, FlipV, Transpose, Rotate90, Transverse, Rotate270}
+
+// OrientationTransform returns the transform that turns an image with the EXIF orientation o upright
+func OrientationTransform(o int) Transform {
+	if o < 1 || o >= len(orientationTransforms) {
+		return Identity
+	}
+	return orientationTransforms[o]
+}
+
+// oriented is a view of an image with a transform applied
+type oriented struct {
+	src  image.Image
+	inv  Transform
+	w, h int
+}
+
+// newOriented returns a view of src transformed by t
+func newOriented(src image.Image, t Transform) *oriented {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if t.Swaps() {
+		w, h = h, w
+	}
+	return &oriented{src: src, inv: t.Inverse(), w: w, h: h}
+}
+
+// ColorModel returns the color model of the source image
+func (o *oriented) ColorModel() color.Model {
+	return o.src.ColorModel()
+}
+
+// Bounds returns the bounds of the transformed image
+func (o *oriented) Bounds() image.Rectangle {
+	return image.Rect(0, 0, o.w, o.h)
+}
+
+// At returns the color of a pixel of the transformed image
+func (o *oriented) At(x, y int) color.Color {
+	return o.src.At(o.source(x, y))
+}
+
+// source returns the location in the source image of a pixel of the transformed image
+func (o *oriented) source(x, y int) (int, int) {
+	sx, sy := o.inv.Point(x, y, o.w, o.h)
+	min := o.src.Bounds().Min
+	return min.X + sx, min.Y + sy
+}
+
+// transform returns the grid rotated and mirrored by t
+func (g *grid) transform(t Transform) *grid {
+	w, h := g.w, g.h
+	if t.Swaps() {
+		w, h = h, w
+	}
+	res := &grid{w: w, h: h, px: make([]float64, len(g.px))}
+	for y := 0; y < g.h; y++ {
+		for x := 0; x < g.w; x++ {
+			tx, ty := t.Point(x, y, g.w, g.h)
+			res.px[ty*w+tx] = g.px[y*g.w+x]
+		}
+	}
+	return res
+}
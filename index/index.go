@@ -0,0 +1,285 @@
+package index
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+	"github.com/marklap/imgdupdetect/datastore"
+	"github.com/marklap/imgdupdetect/img"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// chunks is the number of substrings each fingerprint is split into
+const chunks = 4
+
+// maxVariants caps how many neighbouring substrings a search enumerates before it scans
+// the whole substring table instead
+const maxVariants = 1 << 16
+
+var keyGeneration = []byte("generation")
+
+// Index is a multi-index hash table over the fingerprints of a collection. Every fingerprint is
+// split into chunks substrings and filed under each of them. Two fingerprints within distance d
+// differ by no more than d/chunks bits in at least one of their substrings, so a search only
+// visits the table entries near each substring of the query instead of every fingerprint.
+type Index struct {
+	ds   *datastore.Datastore
+	col  string
+	name []byte
+}
+
+// Name returns the name of the bucket that holds the index of a collection
+func Name(col string) string {
+	return col + ".mih"
+}
+
+// Open opens the index of a collection, (re)building it when it is missing or out of date, and
+// registers it with the datastore so it follows every Add and Remove on the collection. The index
+// is out of date when the collection moved on to another generation without it, which happens
+// when fingerprints are added or removed by a command that did not open the index.
+func Open(ds *datastore.Datastore, col string) (*Index, error) {
+	ix := &Index{
+		ds:   ds,
+		col:  col,
+		name: []byte(Name(col)),
+	}
+
+	err := ds.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(ix.name); b != nil {
+			if v := b.Get(keyGeneration); v != nil && generation(b) == datastore.Generation(tx, col) {
+				return nil
+			}
+			log.Debugf("rebuilding stale index %s", ix.name)
+			if err := tx.DeleteBucket(ix.name); err != nil {
+				return err
+			}
+		}
+		return ix.build(tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ds.AddIndexer(col, ix)
+	return ix, nil
+}
+
+// Drop deletes the index of a collection, if there is one
+func Drop(ds *datastore.Datastore, col string) error {
+	return ds.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(Name(col))) == nil {
+			return nil
+		}
+		return tx.DeleteBucket([]byte(Name(col)))
+	})
+}
+
+// build indexes every fingerprint of the collection
+func (ix *Index) build(tx *bolt.Tx) error {
+	if _, err := tx.CreateBucket(ix.name); err != nil {
+		return err
+	}
+
+	if root := tx.Bucket([]byte(ix.col)); root != nil {
+		err := root.ForEach(func(k, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			return ix.Insert(tx, k)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return ix.sync(tx)
+}
+
+// Insert files a fingerprint under each of its substrings
+func (ix *Index) Insert(tx *bolt.Tx, fp []byte) error {
+	b, err := tx.CreateBucketIfNotExists(ix.name)
+	if err != nil {
+		return err
+	}
+
+	for j := 0; j < chunks; j++ {
+		cb, err := b.CreateBucketIfNotExists([]byte{byte(j)})
+		if err != nil {
+			return err
+		}
+		c, _ := chunk(fp, j)
+		vb, err := cb.CreateBucketIfNotExists(c)
+		if err != nil {
+			return err
+		}
+		if err := vb.Put(fp, []byte{}); err != nil {
+			return err
+		}
+	}
+
+	return ix.sync(tx)
+}
+
+// Delete removes a fingerprint from the table of each of its substrings
+func (ix *Index) Delete(tx *bolt.Tx, fp []byte) error {
+	b := tx.Bucket(ix.name)
+	if b == nil {
+		return nil
+	}
+
+	for j := 0; j < chunks; j++ {
+		cb := b.Bucket([]byte{byte(j)})
+		if cb == nil {
+			continue
+		}
+		c, _ := chunk(fp, j)
+		vb := cb.Bucket(c)
+		if vb == nil {
+			continue
+		}
+		if err := vb.Delete(fp); err != nil {
+			return err
+		}
+		if k, _ := vb.Cursor().First(); k == nil {
+			if err := cb.DeleteBucket(c); err != nil {
+				return err
+			}
+		}
+	}
+
+	return ix.sync(tx)
+}
+
+// Search returns the indexed fingerprints within distance bits of fp
+func (ix *Index) Search(fp []byte, distance int) ([][]byte, error) {
+	if distance < 0 {
+		return nil, fmt.Errorf("negative search distance: %d", distance)
+	}
+
+	var res [][]byte
+	seen := make(map[string]bool)
+	radius := distance / chunks
+
+	err := ix.ds.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ix.name)
+		if b == nil {
+			return nil
+		}
+
+		collect := func(vb *bolt.Bucket) error {
+			return vb.ForEach(func(k, _ []byte) error {
+				if seen[string(k)] {
+					return nil
+				}
+				seen[string(k)] = true
+				if img.Distance(fp, k) <= distance {
+					found := make([]byte, len(k))
+					copy(found, k)
+					res = append(res, found)
+				}
+				return nil
+			})
+		}
+
+		for j := 0; j < chunks; j++ {
+			cb := b.Bucket([]byte{byte(j)})
+			if cb == nil {
+				continue
+			}
+			c, nbits := chunk(fp, j)
+
+			if variants(nbits, radius) > maxVariants {
+				err := cb.ForEach(func(k, v []byte) error {
+					if v == nil && img.Distance(c, k) <= radius {
+						return collect(cb.Bucket(k))
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			var err error
+			flip(c, 0, nbits, radius, func(v []byte) {
+				if vb := cb.Bucket(v); vb != nil && err == nil {
+					err = collect(vb)
+				}
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return res, err
+}
+
+// chunk returns the j-th substring of a fingerprint, packed most significant bit first, and
+// its length in bits
+func chunk(fp []byte, j int) ([]byte, int) {
+	total := len(fp) * 8
+	lo, hi := j*total/chunks, (j+1)*total/chunks
+	n := hi - lo
+
+	size := (n + 7) / 8
+	if size == 0 {
+		size = 1 // an empty substring still needs a non-empty bucket key
+	}
+	res := make([]byte, size)
+	for p := 0; p < n; p++ {
+		if fp[(lo+p)/8]&(0x80>>uint((lo+p)%8)) != 0 {
+			res[p/8] |= 0x80 >> uint(p%8)
+		}
+	}
+	return res, n
+}
+
+// flip calls fn with c and every variant of c that has up to r of its bits from position from
+// onwards flipped; c is restored before flip returns
+func flip(c []byte, from, nbits, r int, fn func([]byte)) {
+	fn(c)
+	if r == 0 {
+		return
+	}
+	for p := from; p < nbits; p++ {
+		c[p/8] ^= 0x80 >> uint(p%8)
+		flip(c, p+1, nbits, r-1, fn)
+		c[p/8] ^= 0x80 >> uint(p%8)
+	}
+}
+
+// variants returns the number of substrings within r bits of an n bit substring
+func variants(n, r int) int {
+	total, c := 0, 1
+	for k := 0; k <= r && k <= n; k++ {
+		total += c
+		if total > maxVariants {
+			return total
+		}
+		c = c * (n - k) / (k + 1)
+	}
+	return total
+}
+
+// sync records that the index is up to date with the current generation of its collection
+func (ix *Index) sync(tx *bolt.Tx) error {
+	b, err := tx.CreateBucketIfNotExists(ix.name)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, datastore.Generation(tx, ix.col))
+	return b.Put(keyGeneration, buf)
+}
+
+// generation returns the generation of the collection the index was last brought up to date with
+func generation(b *bolt.Bucket) uint64 {
+	v := b.Get(keyGeneration)
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
@@ -0,0 +1,150 @@
+package index
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/marklap/imgdupdetect/datastore"
+	"github.com/marklap/imgdupdetect/img"
+)
+
+var (
+	tstDatastorePath = "./testdata.dstore"
+	tstCollection    = "test"
+)
+
+func TestIndex(t *testing.T) {
+	defer os.Remove(tstDatastorePath)
+
+	ds, err := datastore.Open(datastore.Config{Path: tstDatastorePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fingerprints stored before the index exists are picked up when it is built
+	rnd := rand.New(rand.NewSource(1))
+	var fps [][]byte
+	for j := 0; j < 200; j++ {
+		fp := make([]byte, 8)
+		rnd.Read(fp)
+		if j%2 == 1 {
+			// a near neighbour of the previous fingerprint
+			copy(fp, fps[j-1])
+			fp[j%8] ^= 1 << uint(j%7)
+			fp[(j+3)%8] ^= 0x11
+		}
+		fps = append(fps, fp)
+		if j == 100 {
+			if _, err = Open(ds, tstCollection); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ds.Add(tstCollection, fp, fmt.Sprintf("%d.jpg", j), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ix, err := Open(ds, tstCollection)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, distance := range []int{0, 3, 7, 12} {
+		for _, q := range fps {
+			got, err := ix.Search(q, distance)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var want [][]byte
+			for _, fp := range fps {
+				if img.Distance(q, fp) <= distance {
+					want = append(want, fp)
+				}
+			}
+
+			if !sameSet(want, got) {
+				t.Fatalf("search mismatch at distance %d for %x - want: %x, got: %x", distance, q, want, got)
+			}
+		}
+	}
+
+	err = ds.Remove(tstCollection, fps[0], "0.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ix.Search(fps[0], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("removed fingerprint still indexed - want: none, got: %x", got)
+	}
+
+	ds.Close()
+}
+
+func TestStale(t *testing.T) {
+	defer os.Remove(tstDatastorePath)
+
+	ds, err := datastore.Open(datastore.Config{Path: tstDatastorePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { ds.Close() }()
+
+	a := []byte{0, 0, 0, 0, 0, 0, 0, 0}
+	b := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	if err := ds.Add(tstCollection, a, "a.jpg", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(ds, tstCollection); err != nil {
+		t.Fatal(err)
+	}
+
+	// a remove and an add by a command that does not open the index leave the number of
+	// fingerprints as it was
+	ds.Close()
+	if ds, err = datastore.Open(datastore.Config{Path: tstDatastorePath}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Remove(tstCollection, a, "a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Add(tstCollection, b, "b.jpg", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ix, err := Open(ds, tstCollection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ix.Search(a, 0); err != nil || len(got) != 0 {
+		t.Errorf("removed fingerprint still indexed - want: none, got: %x (%v)", got, err)
+	}
+	if got, err := ix.Search(b, 0); err != nil || !sameSet([][]byte{b}, got) {
+		t.Errorf("added fingerprint not indexed - want: %x, got: %x (%v)", b, got, err)
+	}
+}
+
+func sameSet(want, got [][]byte) bool {
+	if len(want) != len(got) {
+		return false
+	}
+	w := make([]string, len(want))
+	g := make([]string, len(got))
+	for j := range want {
+		w[j], g[j] = string(want[j]), string(got[j])
+	}
+	sort.Strings(w)
+	sort.Strings(g)
+	for j := range w {
+		if w[j] != g[j] {
+			return false
+		}
+	}
+	return true
+}
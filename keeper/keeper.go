@@ -0,0 +1,338 @@
+package keeper
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/marklap/imgdupdetect/datastore"
+	"github.com/marklap/imgdupdetect/img"
+)
+
+// MetaDateTime is the metadata key of the EXIF date an image was taken, in unix nanoseconds
+const MetaDateTime = "datetime"
+
+// Policy names as accepted by Parse
+const (
+	NameResolution = "resolution"
+	NameSize       = "size"
+	NameModTime    = "mtime"
+	NameExifDate   = "exif"
+	NamePath       = "path"
+	NameDir        = "dir"
+	NameFormat     = "format"
+)
+
+// Names are the policies Parse accepts; dir and format take an argument after an =
+var Names = []string{NameResolution, NameSize, NameModTime, NameExifDate, NamePath, NameDir + "=PREFIX", NameFormat + "=EXT,EXT..."}
+
+// File is what the policies know about a duplicate
+type File struct {
+	Path    string
+	Size    int64
+	Width   int
+	Height  int
+	ModTime time.Time
+	// Format is the lower case file extension, with jpg spelled jpeg
+	Format string
+
+	taken  time.Time
+	looked bool
+}
+
+// NewFile describes a file from its stored metadata
+func NewFile(path string, meta map[string][]byte) *File {
+	f := &File{
+		Path:   path,
+		Size:   int64(datastore.Uint64Value(meta[datastore.MetaSize])),
+		Width:  int(datastore.Uint64Value(meta["width"])),
+		Height: int(datastore.Uint64Value(meta["height"])),
+		Format: format(path),
+	}
+	if v := datastore.Uint64Value(meta[datastore.MetaModTime]); v != 0 {
+		f.ModTime = time.Unix(0, int64(v))
+	}
+	if v, found := meta[MetaDateTime]; found {
+		f.looked = true
+		if n := datastore.Uint64Value(v); n != 0 {
+			f.taken = time.Unix(0, int64(n))
+		}
+	}
+	return f
+}
+
+// Taken returns the EXIF date the image was taken, or the zero time when it has none. Files
+// stored without the date have it read from the file on first use.
+func (f *File) Taken() time.Time {
+	if f.looked {
+		return f.taken
+	}
+	f.looked = true
+	i, err := img.NewImage(f.Path)
+	if err != nil {
+		return f.taken
+	}
+	if dt, err := i.ExifDateTime(); err == nil {
+		f.taken = dt
+	}
+	return f.taken
+}
+
+// Policy prefers one of two duplicates to keep
+type Policy interface {
+	// Compare returns a negative number when a is the better file to keep, a positive number
+	// when b is and 0 when the policy prefers neither
+	Compare(a, b *File) int
+
+	// String returns the policy as Parse accepts it
+	String() string
+}
+
+// Chain is a list of policies where each breaks the ties of the ones before it
+type Chain []Policy
+
+// Default is the chain used when none is given
+var Default = Chain{Resolution{}, Size{}}
+
+// Compare returns the verdict of the first policy that prefers one of the files
+func (c Chain) Compare(a, b *File) int {
+	for _, p := range c {
+		if n := p.Compare(a, b); n != 0 {
+			return n
+		}
+	}
+	return 0
+}
+
+// Select returns the index of the file to keep; the first file wins a complete tie
+func (c Chain) Select(files []*File) int {
+	best := 0
+	for j := 1; j < len(files); j++ {
+		if c.Compare(files[j], files[best]) < 0 {
+			best = j
+		}
+	}
+	return best
+}
+
+// Choose returns the name of the file to keep among names, described by their stored metadata.
+// An empty chain chooses as Default does.
+func Choose(keep Chain, names []string, meta map[string]map[string][]byte) string {
+	if len(keep) == 0 {
+		keep = Default
+	}
+	files := make([]*File, len(names))
+	for j, name := range names {
+		files[j] = NewFile(name, meta[name])
+	}
+	return names[keep.Select(files)]
+}
+
+// String returns the policies separated by spaces
+func (c Chain) String() string {
+	names := make([]string, len(c))
+	for j, p := range c {
+		names[j] = p.String()
+	}
+	return strings.Join(names, " ")
+}
+
+// Set appends a policy parsed from s, so a Chain can be a repeatable flag
+func (c *Chain) Set(s string) error {
+	p, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*c = append(*c, p)
+	return nil
+}
+
+// Parse returns the policy named by s, see Names
+func Parse(s string) (Policy, error) {
+	name, arg := s, ""
+	if j := strings.Index(s, "="); j >= 0 {
+		name, arg = s[:j], s[j+1:]
+	}
+
+	switch name {
+	case NameResolution:
+		return Resolution{}, nil
+	case NameSize:
+		return Size{}, nil
+	case NameModTime:
+		return ModTime{}, nil
+	case NameExifDate:
+		return ExifDate{}, nil
+	case NamePath:
+		return ShortestPath{}, nil
+	case NameDir:
+		if arg == "" {
+			return nil, fmt.Errorf("keeper policy %s needs a directory prefix", name)
+		}
+		// the paths in the datastore are absolute, so a relative prefix is taken from the
+		// working directory
+		prefix, err := filepath.Abs(arg)
+		if err != nil {
+			return nil, err
+		}
+		return Dir{Prefix: prefix}, nil
+	case NameFormat:
+		var order []string
+		for _, f := range strings.Split(arg, ",") {
+			if f = normalizeFormat(f); f != "" {
+				order = append(order, f)
+			}
+		}
+		if len(order) == 0 {
+			return nil, fmt.Errorf("keeper policy %s needs a list of formats", name)
+		}
+		return Format{Order: order}, nil
+	}
+	return nil, fmt.Errorf("unknown keeper policy: %s", s)
+}
+
+// Resolution keeps the image with the most pixels
+type Resolution struct{}
+
+// Compare implements Policy
+func (Resolution) Compare(a, b *File) int {
+	return compareInt64(int64(b.Width)*int64(b.Height), int64(a.Width)*int64(a.Height))
+}
+
+func (Resolution) String() string { return NameResolution }
+
+// Size keeps the largest file
+type Size struct{}
+
+// Compare implements Policy
+func (Size) Compare(a, b *File) int {
+	return compareInt64(b.Size, a.Size)
+}
+
+func (Size) String() string { return NameSize }
+
+// ModTime keeps the file modified longest ago; files without a stored time lose
+type ModTime struct{}
+
+// Compare implements Policy
+func (ModTime) Compare(a, b *File) int {
+	return compareTime(a.ModTime, b.ModTime)
+}
+
+func (ModTime) String() string { return NameModTime }
+
+// ExifDate keeps the image taken earliest according to its EXIF DateTime; images without one lose
+type ExifDate struct{}
+
+// Compare implements Policy
+func (ExifDate) Compare(a, b *File) int {
+	return compareTime(a.Taken(), b.Taken())
+}
+
+func (ExifDate) String() string { return NameExifDate }
+
+// ShortestPath keeps the file with the shortest path
+type ShortestPath struct{}
+
+// Compare implements Policy
+func (ShortestPath) Compare(a, b *File) int {
+	return compareInt64(int64(len(a.Path)), int64(len(b.Path)))
+}
+
+func (ShortestPath) String() string { return NamePath }
+
+// Dir keeps the file within a directory
+type Dir struct {
+	Prefix string
+}
+
+// Compare implements Policy
+func (d Dir) Compare(a, b *File) int {
+	return compareBool(d.within(a.Path), d.within(b.Path))
+}
+
+func (d Dir) within(path string) bool {
+	prefix := filepath.Clean(d.Prefix)
+	return path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, string(filepath.Separator))+string(filepath.Separator))
+}
+
+func (d Dir) String() string { return NameDir + "=" + d.Prefix }
+
+// Format keeps the file whose format comes first in Order; formats not listed lose
+type Format struct {
+	Order []string
+}
+
+// Compare implements Policy
+func (f Format) Compare(a, b *File) int {
+	return compareInt64(int64(f.rank(a.Format)), int64(f.rank(b.Format)))
+}
+
+func (f Format) rank(format string) int {
+	for j, o := range f.Order {
+		if o == format {
+			return j
+		}
+	}
+	return len(f.Order)
+}
+
+func (f Format) String() string { return NameFormat + "=" + strings.Join(f.Order, ",") }
+
+// format returns the normalized format of a path from its extension
+func format(path string) string {
+	file, _ := img.SplitPage(path)
+	return normalizeFormat(filepath.Ext(file))
+}
+
+// normalizeFormat lower cases a format or extension and spells jpg and tif out
+func normalizeFormat(f string) string {
+	f = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(f), "."))
+	switch f {
+	case "jpg":
+		return "jpeg"
+	case "tif":
+		return "tiff"
+	}
+	return f
+}
+
+// compareInt64 orders the smaller number first
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareTime orders the earlier time first and the zero time last
+func compareTime(a, b time.Time) int {
+	switch {
+	case a.IsZero() && b.IsZero():
+		return 0
+	case a.IsZero():
+		return 1
+	case b.IsZero():
+		return -1
+	case a.Before(b):
+		return -1
+	case b.Before(a):
+		return 1
+	}
+	return 0
+}
+
+// compareBool orders true first
+func compareBool(a, b bool) int {
+	switch {
+	case a && !b:
+		return -1
+	case b && !a:
+		return 1
+	}
+	return 0
+}
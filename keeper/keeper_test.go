@@ -0,0 +1,111 @@
+package keeper
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/marklap/imgdupdetect/datastore"
+)
+
+func u64(n uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, n)
+	return buf
+}
+
+func TestNewFile(t *testing.T) {
+	f := NewFile("/photos/a.JPG", map[string][]byte{
+		datastore.MetaSize:    u64(100),
+		datastore.MetaModTime: u64(uint64(time.Unix(10, 0).UnixNano())),
+		MetaDateTime:          u64(0),
+		"width":               u64(20),
+		"height":              u64(10),
+	})
+	if f.Size != 100 || f.Width != 20 || f.Height != 10 || f.Format != "jpeg" || !f.ModTime.Equal(time.Unix(10, 0)) {
+		t.Errorf("file mismatch - got: %+v", f)
+	}
+	// a stored zero date means the image has none; the missing file is not read
+	if !f.Taken().IsZero() {
+		t.Errorf("taken mismatch - want: zero, got: %s", f.Taken())
+	}
+}
+
+func TestSelect(t *testing.T) {
+	files := []*File{
+		{Path: "/b/long/name.jpeg", Size: 300, Width: 100, Height: 100, Format: "jpeg", ModTime: time.Unix(30, 0), looked: true},
+		{Path: "/a/x.png", Size: 200, Width: 200, Height: 100, Format: "png", ModTime: time.Unix(20, 0), looked: true, taken: time.Unix(50, 0)},
+		{Path: "/a/y.jpeg", Size: 400, Width: 200, Height: 100, Format: "jpeg", looked: true, taken: time.Unix(40, 0)},
+	}
+	// the directory prefix is relative to the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(wd, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tst := range []struct {
+		policies []string
+		want     int
+	}{
+		{nil, 0},
+		{[]string{"resolution"}, 1},
+		{[]string{"resolution", "size"}, 2},
+		{[]string{"size"}, 2},
+		{[]string{"mtime"}, 1},
+		{[]string{"exif"}, 2},
+		{[]string{"path"}, 1},
+		{[]string{"dir=/b"}, 0},
+		{[]string{"dir=/a/"}, 1},
+		{[]string{"dir=" + rel}, 1},
+		{[]string{"format=png,jpg"}, 1},
+		{[]string{"format=jpg", "size"}, 2},
+	} {
+		var c Chain
+		for _, p := range tst.policies {
+			if err := c.Set(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := c.Select(files); got != tst.want {
+			t.Errorf("keeper mismatch for %v - want: %d, got: %d", tst.policies, tst.want, got)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, s := range []string{"bogus", "dir", "dir=", "format=", "format=,"} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("invalid policy accepted: %s", s)
+		}
+	}
+	for _, s := range []string{"resolution", "size", "mtime", "exif", "path", "dir=/a", "format=png,jpeg"} {
+		p, err := Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.String() != s {
+			t.Errorf("policy name mismatch - want: %s, got: %s", s, p.String())
+		}
+	}
+}
+
+func TestChoose(t *testing.T) {
+	meta := map[string]map[string][]byte{
+		"/a/sm.jpg":    {datastore.MetaSize: u64(100), MetaDateTime: u64(0), "width": u64(10), "height": u64(10)},
+		"/a/large.jpg": {datastore.MetaSize: u64(100), MetaDateTime: u64(0), "width": u64(20), "height": u64(10)},
+	}
+	names := []string{"/a/sm.jpg", "/a/large.jpg"}
+
+	if got := Choose(nil, names, meta); got != "/a/large.jpg" {
+		t.Errorf("default keeper mismatch - want: /a/large.jpg, got: %s", got)
+	}
+	if got := Choose(Chain{ShortestPath{}}, names, meta); got != "/a/sm.jpg" {
+		t.Errorf("keeper mismatch - want: /a/sm.jpg, got: %s", got)
+	}
+}
@@ -0,0 +1,365 @@
+// Package layout expands the templates that decide where relocated images go.
+//
+// A template is a slash separated path with variables in braces, such as
+// {year}/{month}/{camera_model}/{date}_{counter}.{ext}. A variable may take an argument after a
+// colon: the number of digits for {counter} and {suffix}, the number of hex digits for {fp} and
+// {hash}, and lower or upper for the text variables.
+package layout
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Variable names
+const (
+	VarYear        = "year"
+	VarMonth       = "month"
+	VarDay         = "day"
+	VarHour        = "hour"
+	VarMinute      = "minute"
+	VarSecond      = "second"
+	VarDate        = "date"
+	VarTime        = "time"
+	VarDateSource  = "date_source"
+	VarCameraMake  = "camera_make"
+	VarCameraModel = "camera_model"
+	VarLens        = "lens"
+	VarName        = "name"
+	VarExt         = "ext"
+	VarWidth       = "width"
+	VarHeight      = "height"
+	VarFingerPrint = "fp"
+	VarHash        = "hash"
+	VarCounter     = "counter"
+	VarSuffix      = "suffix"
+	VarRandom      = "random"
+)
+
+// Names are the variables in the order they are documented
+var Names = []string{
+	VarYear, VarMonth, VarDay, VarHour, VarMinute, VarSecond, VarDate, VarTime, VarDateSource,
+	VarCameraMake, VarCameraModel, VarLens, VarName, VarExt, VarWidth, VarHeight,
+	VarFingerPrint, VarHash, VarCounter, VarSuffix, VarRandom,
+}
+
+// Default puts images in a folder per day under their original name and a prefix of their
+// content hash, so relocating the same image twice gives it the same name
+const Default = "{date}/{name:lower}.{hash}{suffix}.{ext}"
+
+// Undated is the layout of images no date source knows a date for, used in place of a layout
+// that needs one
+const Undated = "undated/{name:lower}.{hash}{suffix}.{ext}"
+
+// Duplicates is the layout of images relocation found to duplicate an image already in the
+// target tree
+const Duplicates = "duplicates/{name:lower}.{hash}{suffix}.{ext}"
+
+// unknown stands in for text variables the image has no value for
+const unknown = "unknown"
+
+// hexDigits are the number of hex digits the hex variables expand to without an argument
+var hexDigits = map[string]int{
+	VarFingerPrint: 8,
+	VarHash:        12,
+}
+
+// ErrNoDate is returned by Expand when the template needs the date an image was taken and it
+// has none
+var ErrNoDate = errors.New("image has no date")
+
+// kind is how a variable is expanded and which arguments it takes
+type kind int
+
+const (
+	kindDate kind = iota
+	kindText
+	kindNumber
+	kindHex
+	kindCounter
+)
+
+// variables are the known variables and their kind
+var variables = map[string]kind{
+	VarYear:        kindDate,
+	VarMonth:       kindDate,
+	VarDay:         kindDate,
+	VarHour:        kindDate,
+	VarMinute:      kindDate,
+	VarSecond:      kindDate,
+	VarDate:        kindDate,
+	VarTime:        kindDate,
+	VarDateSource:  kindText,
+	VarCameraMake:  kindText,
+	VarCameraModel: kindText,
+	VarLens:        kindText,
+	VarName:        kindText,
+	VarExt:         kindText,
+	VarRandom:      kindText,
+	VarWidth:       kindNumber,
+	VarHeight:      kindNumber,
+	VarFingerPrint: kindHex,
+	VarHash:        kindHex,
+	VarCounter:     kindCounter,
+	VarSuffix:      kindCounter,
+}
+
+// dateFormats are the time layouts of the date variables
+var dateFormats = map[string]string{
+	VarYear:   "2006",
+	VarMonth:  "01",
+	VarDay:    "02",
+	VarHour:   "15",
+	VarMinute: "04",
+	VarSecond: "05",
+	VarDate:   "2006-01-02",
+	VarTime:   "150405",
+}
+
+// Vars are the values a template is expanded with
+type Vars struct {
+	// Taken is when the image was taken; zero when it is not known
+	Taken time.Time
+	// DateSource is where Taken came from
+	DateSource  string
+	CameraMake  string
+	CameraModel string
+	Lens        string
+	// Name is the base name of the image without its extension
+	Name string
+	// Ext is the extension of the image without the dot
+	Ext         string
+	Width       int
+	Height      int
+	FingerPrint []byte
+	// Hash is the content hash of the file
+	Hash []byte
+	// Random is a random string that makes a name unique
+	Random string
+}
+
+// part is a run of literal text or a variable of a template
+type part struct {
+	text string
+	name string
+	arg  string
+}
+
+// Template is a parsed layout
+type Template struct {
+	raw   string
+	parts []part
+}
+
+// Parse parses a layout template
+func Parse(s string) (*Template, error) {
+	if s == "" {
+		return nil, fmt.Errorf("empty layout")
+	}
+	if path.IsAbs(s) || filepath.IsAbs(s) {
+		return nil, fmt.Errorf("layout must be a relative path: %s", s)
+	}
+
+	t := &Template{raw: s}
+	rest := s
+	for rest != "" {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			t.parts = append(t.parts, part{text: rest})
+			break
+		}
+		if rest[open] == '}' {
+			return nil, fmt.Errorf("unexpected } in layout: %s", s)
+		}
+		if open > 0 {
+			t.parts = append(t.parts, part{text: rest[:open]})
+		}
+		end := strings.IndexAny(rest[open+1:], "{}")
+		if end < 0 || rest[open+1+end] != '}' {
+			return nil, fmt.Errorf("unclosed { in layout: %s", s)
+		}
+		p, err := parseVar(rest[open+1 : open+1+end])
+		if err != nil {
+			return nil, err
+		}
+		t.parts = append(t.parts, p)
+		rest = rest[open+end+2:]
+	}
+
+	for _, p := range t.parts {
+		if p.name != "" {
+			continue
+		}
+		for _, elem := range strings.Split(p.text, "/") {
+			if elem == ".." {
+				return nil, fmt.Errorf("layout must not leave the target directory: %s", s)
+			}
+		}
+	}
+	return t, nil
+}
+
+// parseVar parses the inside of the braces of a variable
+func parseVar(s string) (part, error) {
+	name, arg := s, ""
+	if j := strings.Index(s, ":"); j >= 0 {
+		name, arg = s[:j], s[j+1:]
+	}
+
+	k, found := variables[name]
+	if !found {
+		return part{}, fmt.Errorf("unknown layout variable: %s", name)
+	}
+	if arg == "" {
+		return part{name: name}, nil
+	}
+
+	switch k {
+	case kindText:
+		if arg == "lower" || arg == "upper" {
+			return part{name: name, arg: arg}, nil
+		}
+	case kindCounter, kindHex:
+		if n, err := strconv.Atoi(arg); err == nil && n > 0 {
+			return part{name: name, arg: arg}, nil
+		}
+	}
+	return part{}, fmt.Errorf("invalid argument for layout variable %s: %s", name, arg)
+}
+
+// String returns the template as it was parsed
+func (t *Template) String() string {
+	return t.raw
+}
+
+// Uses reports whether the template has any of the variables
+func (t *Template) Uses(names ...string) bool {
+	for _, p := range t.parts {
+		for _, n := range names {
+			if p.name == n {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// UsesDate reports whether the template needs the date an image was taken
+func (t *Template) UsesDate() bool {
+	for _, p := range t.parts {
+		if p.name != "" && variables[p.name] == kindDate {
+			return true
+		}
+	}
+	return false
+}
+
+// Expand returns the relative path the template gives an image, using counter for {counter}.
+// Values are cleaned so they cannot add directories of their own.
+func (t *Template) Expand(v Vars, counter int) (string, error) {
+	var b strings.Builder
+	for _, p := range t.parts {
+		if p.name == "" {
+			b.WriteString(p.text)
+			continue
+		}
+
+		switch variables[p.name] {
+		case kindDate:
+			if v.Taken.IsZero() {
+				return "", ErrNoDate
+			}
+			b.WriteString(v.Taken.Format(dateFormats[p.name]))
+		case kindText:
+			s := clean(v.text(p.name))
+			switch p.arg {
+			case "lower":
+				s = strings.ToLower(s)
+			case "upper":
+				s = strings.ToUpper(s)
+			}
+			b.WriteString(s)
+		case kindNumber:
+			n := v.Width
+			if p.name == VarHeight {
+				n = v.Height
+			}
+			b.WriteString(strconv.Itoa(n))
+		case kindHex:
+			digits := hexDigits[p.name]
+			if p.arg != "" {
+				digits, _ = strconv.Atoi(p.arg)
+			}
+			sum := v.FingerPrint
+			if p.name == VarHash {
+				sum = v.Hash
+			}
+			s := hex.EncodeToString(sum)
+			if len(s) > digits {
+				s = s[:digits]
+			}
+			if s == "" {
+				s = unknown
+			}
+			b.WriteString(s)
+		case kindCounter:
+			width := 1
+			if p.arg != "" {
+				width, _ = strconv.Atoi(p.arg)
+			}
+			// {suffix} only tells apart the images that would otherwise get the same name
+			if p.name == VarSuffix {
+				if counter > 1 {
+					fmt.Fprintf(&b, "-%0*d", width, counter)
+				}
+				continue
+			}
+			fmt.Fprintf(&b, "%0*d", width, counter)
+		}
+	}
+	return filepath.FromSlash(path.Clean(b.String())), nil
+}
+
+// text returns the value of a text variable
+func (v Vars) text(name string) string {
+	switch name {
+	case VarDateSource:
+		return v.DateSource
+	case VarCameraMake:
+		return v.CameraMake
+	case VarCameraModel:
+		return v.CameraModel
+	case VarLens:
+		return v.Lens
+	case VarName:
+		return v.Name
+	case VarExt:
+		return v.Ext
+	case VarRandom:
+		return v.Random
+	}
+	return ""
+}
+
+// clean makes a value safe to use as part of a path element; empty values become unknown
+func clean(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < ' ' || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(s))
+	switch s {
+	case "":
+		return unknown
+	case ".", "..":
+		return "_"
+	}
+	return s
+}
@@ -0,0 +1,77 @@
+package layout
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	for _, tst := range []struct {
+		layout string
+		ok     bool
+	}{
+		{Default, true},
+		{"{year}/{month}/{camera_model}/{date}_{counter}.{ext}", true},
+		{"{fp:12}.{ext:upper}", true},
+		{"{counter:4}", true},
+		{"", false},
+		{"/abs/{name}", false},
+		{"../{name}", false},
+		{"{nope}", false},
+		{"{name", false},
+		{"name}", false},
+		{"{counter:x}", false},
+		{"{year:lower}", false},
+	} {
+		_, err := Parse(tst.layout)
+		if (err == nil) != tst.ok {
+			t.Errorf("parse %q - want ok: %t, got: %v", tst.layout, tst.ok, err)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	vars := Vars{
+		Taken:       time.Date(2019, 5, 4, 10, 11, 12, 0, time.UTC),
+		CameraModel: "EOS 5D/Mark II",
+		Name:        "IMG_0001",
+		Ext:         "jpg",
+		Width:       640,
+		Height:      480,
+		FingerPrint: []byte{0xab, 0xcd, 0xef, 0x01, 0x23},
+		Hash:        []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef},
+		Random:      "r",
+	}
+
+	for _, tst := range []struct {
+		layout  string
+		counter int
+		want    string
+	}{
+		{Default, 1, "2019-05-04/img_0001.0123456789ab.jpg"},
+		{Default, 3, "2019-05-04/img_0001.0123456789ab-3.jpg"},
+		{"{name}.{random}{suffix:2}.{ext}", 2, "IMG_0001.r-02.jpg"},
+		{"{hash:4}", 1, "0123"},
+		{"{year}/{month}/{camera_model}/{date}_{counter}.{ext}", 2, "2019/05/EOS 5D_Mark II/2019-05-04_2.jpg"},
+		{"{camera_make}/{lens}/{time}_{counter:3}", 7, "unknown/unknown/101112_007"},
+		{"{width}x{height}/{fp}/{fp:4}.{ext:upper}", 1, "640x480/abcdef01/abcd.JPG"},
+	} {
+		tmpl, err := Parse(tst.layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := tmpl.Expand(vars, tst.counter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := filepath.FromSlash(tst.want); got != want {
+			t.Errorf("expand %q - want: %s, got: %s", tst.layout, want, got)
+		}
+	}
+
+	tmpl, _ := Parse(Default)
+	if _, err := tmpl.Expand(Vars{Name: "a", Ext: "jpg"}, 1); err != ErrNoDate {
+		t.Errorf("expand without a date - want: %v, got: %v", ErrNoDate, err)
+	}
+}
@@ -0,0 +1,108 @@
+package match
+
+import (
+	"sort"
+
+	"github.com/marklap/imgdupdetect/datastore"
+	"github.com/marklap/imgdupdetect/img"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MetaKeyPoints is the metadata key of the encoded keypoints of an image
+const MetaKeyPoints = "keypoints"
+
+// minSharedPatches is how many keypoint hash substrings two images must share before their
+// keypoints are compared in full
+const minSharedPatches = 8
+
+// Containment is an image found inside another image
+type Containment struct {
+	img.Containment
+	// Inner is the path of the contained image
+	Inner string
+	// Outer is the path of the image it was found in
+	Outer string
+}
+
+// Containments finds the images of a collection that are crops of other images. Only images
+// stored with keypoints (see img.AlgoKeyPoints) are considered. The search is not exhaustive:
+// images are only compared in full when enough of their patches share a quarter of their hash,
+// so a crop whose matching patches all differ from the original in every quarter can be missed.
+func Containments(ds *datastore.Datastore, col string) ([]Containment, error) {
+	var names []string
+	var sets []*img.KeyPointSet
+	for _, fp := range ds.GetFingerPrints(col) {
+		files, err := ds.Get(col, fp)
+		if err != nil {
+			return nil, err
+		}
+		for name, meta := range files {
+			buf, found := meta[MetaKeyPoints]
+			if !found {
+				continue
+			}
+			s, err := img.DecodeKeyPoints(buf)
+			if err != nil {
+				log.Errorf("%s: %s", name, err)
+				continue
+			}
+			names = append(names, name)
+			sets = append(sets, s)
+		}
+	}
+
+	// patches that differ in fewer than 4 bits share at least one 16 bit quarter of their hash.
+	// Patches may match with more differing bits than that, up to the keypoint distance, and
+	// then only share a quarter when their differences happen to leave one out. Splitting the
+	// hash into enough chunks to be certain would leave chunks so short that every pair of
+	// images passes, so the quarters stay a heuristic that keeps the full comparison to images
+	// that have something in common.
+	type quarter struct {
+		j int
+		v uint16
+	}
+	owners := make(map[quarter][]int)
+	for n, s := range sets {
+		seen := make(map[quarter]bool)
+		for _, p := range s.Points {
+			for j := 0; j < 4; j++ {
+				q := quarter{j, uint16(p.Hash >> uint(16*j))}
+				if !seen[q] {
+					seen[q] = true
+					owners[q] = append(owners[q], n)
+				}
+			}
+		}
+	}
+
+	var res []Containment
+	for a, s := range sets {
+		shared := make(map[int]int)
+		for _, p := range s.Points {
+			for j := 0; j < 4; j++ {
+				for _, b := range owners[quarter{j, uint16(p.Hash >> uint(16*j))}] {
+					if b != a {
+						shared[b]++
+					}
+				}
+			}
+		}
+		for b, n := range shared {
+			if n < minSharedPatches {
+				continue
+			}
+			if c, found := s.ContainedIn(sets[b]); found {
+				res = append(res, Containment{Containment: c, Inner: names[a], Outer: names[b]})
+			}
+		}
+	}
+
+	sort.Slice(res, func(a, b int) bool {
+		if res[a].Outer != res[b].Outer {
+			return res[a].Outer < res[b].Outer
+		}
+		return res[a].Inner < res[b].Inner
+	})
+	return res, nil
+}
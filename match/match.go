@@ -0,0 +1,157 @@
+package match
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/marklap/imgdupdetect/datastore"
+	"github.com/marklap/imgdupdetect/img"
+)
+
+// Pair is two images of a group and the distance between their fingerprints
+type Pair struct {
+	A        string
+	B        string
+	Distance int
+	// Transform is how B is rotated or mirrored relative to A, for canonical fingerprints
+	Transform img.Transform
+}
+
+// MetaTransform is the metadata key of the transform taking an image to its canonical orientation
+const MetaTransform = "transform"
+
+// Searcher finds the stored fingerprints within a distance of a fingerprint
+type Searcher interface {
+	Search(fp []byte, distance int) ([][]byte, error)
+}
+
+// Group is a set of images whose fingerprints are within the threshold of each other
+type Group struct {
+	// FingerPrints are the distinct fingerprints of the images in the group
+	FingerPrints [][]byte
+	// Images are the paths of the images in the group
+	Images []string
+	// Pairs are the image pairs within the threshold and their distance
+	Pairs []Pair
+	// Meta is the metadata stored for each image
+	Meta map[string]map[string][]byte
+
+	fps map[string][]byte
+}
+
+// FingerPrint returns the fingerprint stored for an image of the group
+func (g *Group) FingerPrint(image string) []byte {
+	return g.fps[image]
+}
+
+// Groups finds the groups of duplicate images in a collection. Fingerprints are considered
+// the same image when they differ by no more than threshold bits; a threshold of 0 only groups
+// images with identical fingerprints. Neighbouring fingerprints are looked up with s, or by
+// comparing every pair of fingerprints when s is nil.
+func Groups(ds *datastore.Datastore, col string, threshold int, s Searcher) ([]Group, error) {
+	fps := ds.GetFingerPrints(col)
+
+	// union-find over the fingerprints
+	parent := make([]int, len(fps))
+	for j := range parent {
+		parent[j] = j
+	}
+	var find func(int) int
+	find = func(j int) int {
+		if parent[j] != j {
+			parent[j] = find(parent[j])
+		}
+		return parent[j]
+	}
+
+	if threshold > 0 && s != nil {
+		pos := make(map[string]int, len(fps))
+		for j, fp := range fps {
+			pos[string(fp)] = j
+		}
+		for a := range fps {
+			near, err := s.Search(fps[a], threshold)
+			if err != nil {
+				return nil, err
+			}
+			for _, n := range near {
+				if b, found := pos[string(n)]; found {
+					parent[find(b)] = find(a)
+				}
+			}
+		}
+	} else if threshold > 0 {
+		for a := range fps {
+			for b := a + 1; b < len(fps); b++ {
+				if img.Distance(fps[a], fps[b]) <= threshold {
+					parent[find(b)] = find(a)
+				}
+			}
+		}
+	}
+
+	members := make(map[int][]int)
+	for j := range fps {
+		root := find(j)
+		members[root] = append(members[root], j)
+	}
+
+	var res []Group
+	for _, m := range members {
+		g := Group{
+			Meta: make(map[string]map[string][]byte),
+			fps:  make(map[string][]byte),
+		}
+		for _, j := range m {
+			g.FingerPrints = append(g.FingerPrints, fps[j])
+			files, err := ds.Get(col, fps[j])
+			if err != nil {
+				return nil, err
+			}
+			for i, meta := range files {
+				g.Images = append(g.Images, i)
+				g.Meta[i] = meta
+				g.fps[i] = fps[j]
+			}
+		}
+		if len(g.Images) < 2 {
+			continue
+		}
+		sort.Strings(g.Images)
+		sort.Slice(g.FingerPrints, func(a, b int) bool {
+			return bytes.Compare(g.FingerPrints[a], g.FingerPrints[b]) < 0
+		})
+		g.Pairs = pairs(g, threshold)
+		res = append(res, g)
+	}
+
+	sort.Slice(res, func(a, b int) bool {
+		return bytes.Compare(res[a].FingerPrints[0], res[b].FingerPrints[0]) < 0
+	})
+	return res, nil
+}
+
+// pairs returns every pair of images in the group within the threshold
+func pairs(g Group, threshold int) []Pair {
+	var res []Pair
+	for a := range g.Images {
+		for b := a + 1; b < len(g.Images); b++ {
+			d := img.Distance(g.fps[g.Images[a]], g.fps[g.Images[b]])
+			if d > threshold {
+				continue
+			}
+			// A goes to the canonical orientation and from there back to B
+			t := transform(g.Meta[g.Images[a]]).Then(transform(g.Meta[g.Images[b]]).Inverse())
+			res = append(res, Pair{A: g.Images[a], B: g.Images[b], Distance: d, Transform: t})
+		}
+	}
+	return res
+}
+
+// transform returns the canonical orientation transform stored in an image's metadata
+func transform(meta map[string][]byte) img.Transform {
+	if v := meta[MetaTransform]; len(v) == 1 && int(v[0]) < len(img.Transforms) {
+		return img.Transform(v[0])
+	}
+	return img.Identity
+}
@@ -0,0 +1,166 @@
+package match
+
+import (
+	"os"
+	"testing"
+
+	"github.com/marklap/imgdupdetect/datastore"
+	"github.com/marklap/imgdupdetect/img"
+)
+
+var (
+	tstDatastorePath = "./testdata.dstore"
+	tstCollection    = "test"
+)
+
+func openDatastore(t *testing.T) *datastore.Datastore {
+	ds, err := datastore.Open(datastore.Config{Path: tstDatastorePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tst := range []struct {
+		fp   []byte
+		name string
+	}{
+		{[]byte{0x00, 0x00}, "a.jpg"},
+		{[]byte{0x00, 0x00}, "b.jpg"},
+		{[]byte{0x00, 0x03}, "c.jpg"},
+		{[]byte{0xff, 0xff}, "d.jpg"},
+		{[]byte{0xff, 0x7f}, "e.jpg"},
+		{[]byte{0x0f, 0xf0}, "f.jpg"},
+	} {
+		err := ds.Add(tstCollection, tst.fp, tst.name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ds
+}
+
+func closeDatastore(t *testing.T, ds *datastore.Datastore) {
+	ds.Close()
+	err := os.Remove(tstDatastorePath)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	ds := openDatastore(t)
+	defer closeDatastore(t, ds)
+
+	for _, tst := range []struct {
+		threshold int
+		want      [][]string
+	}{
+		{0, [][]string{{"a.jpg", "b.jpg"}}},
+		{1, [][]string{{"a.jpg", "b.jpg"}, {"d.jpg", "e.jpg"}}},
+		{2, [][]string{{"a.jpg", "b.jpg", "c.jpg"}, {"d.jpg", "e.jpg"}}},
+	} {
+		got, err := Groups(ds, tstCollection, tst.threshold, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(tst.want) {
+			t.Fatalf("group count mismatch at threshold %d - want: %d, got: %d", tst.threshold, len(tst.want), len(got))
+		}
+		for j, g := range got {
+			if len(g.Images) != len(tst.want[j]) {
+				t.Errorf("group size mismatch at threshold %d - want: %s, got: %s", tst.threshold, tst.want[j], g.Images)
+				continue
+			}
+			for k := range g.Images {
+				if g.Images[k] != tst.want[j][k] {
+					t.Errorf("group mismatch at threshold %d - want: %s, got: %s", tst.threshold, tst.want[j], g.Images)
+				}
+			}
+		}
+	}
+
+	got, err := Groups(ds, tstCollection, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range got[0].Pairs {
+		want := 0
+		if p.B == "c.jpg" {
+			want = 2
+		}
+		if p.Distance != want {
+			t.Errorf("pair distance mismatch for %s and %s - want: %d, got: %d", p.A, p.B, want, p.Distance)
+		}
+	}
+	if len(got[0].Pairs) != 3 {
+		t.Errorf("pair count mismatch - want: 3, got: %d", len(got[0].Pairs))
+	}
+}
+
+func TestGroupsTransform(t *testing.T) {
+	defer os.Remove(tstDatastorePath)
+
+	ds, err := datastore.Open(datastore.Config{Path: tstDatastorePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	fp := []byte{0x12, 0x34}
+	for name, tr := range map[string]img.Transform{"a.jpg": img.Identity, "b.jpg": img.Rotate270} {
+		err := ds.Add(tstCollection, fp, name, map[string][]byte{MetaTransform: {byte(tr)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := Groups(ds, tstCollection, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || len(got[0].Pairs) != 1 {
+		t.Fatalf("pair mismatch - want: 1 group with 1 pair, got: %v", got)
+	}
+	if p := got[0].Pairs[0]; p.Transform != img.Rotate90 {
+		t.Errorf("transform mismatch - want: %s, got: %s", img.Rotate90, p.Transform)
+	}
+}
+
+func TestContainments(t *testing.T) {
+	defer os.Remove(tstDatastorePath)
+
+	ds, err := datastore.Open(datastore.Config{Path: tstDatastorePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	// the inner image is the top left quarter of the outer one, shifted by 100,50
+	outer := &img.KeyPointSet{Width: 400, Height: 200}
+	inner := &img.KeyPointSet{Width: 200, Height: 100}
+	for j := 0; j < 20; j++ {
+		p := img.KeyPoint{X: 100 + j*5, Y: 50 + j*2, Hash: uint64(j+1) * 0x9e3779b97f4a7c15}
+		outer.Points = append(outer.Points, p)
+		inner.Points = append(inner.Points, img.KeyPoint{X: p.X - 100, Y: p.Y - 50, Hash: p.Hash ^ 1})
+	}
+
+	for name, s := range map[string]*img.KeyPointSet{"outer.jpg": outer, "inner.jpg": inner} {
+		err := ds.Add(tstCollection, []byte(name), name, map[string][]byte{MetaKeyPoints: img.EncodeKeyPoints(s)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := Containments(ds, tstCollection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("containment count mismatch - want: 1, got: %d", len(got))
+	}
+	if got[0].Inner != "inner.jpg" || got[0].Outer != "outer.jpg" {
+		t.Errorf("containment mismatch - want: inner.jpg in outer.jpg, got: %s in %s", got[0].Inner, got[0].Outer)
+	}
+	if got[0].DX != 100 || got[0].DY != 50 || got[0].Overlap != 0.25 {
+		t.Errorf("containment position mismatch - want: 100,50 (0.25), got: %d,%d (%f)", got[0].DX, got[0].DY, got[0].Overlap)
+	}
+}
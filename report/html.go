@@ -0,0 +1,211 @@
+package report
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+
+	"github.com/marklap/imgdupdetect/img"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FormatHTML writes a static site to a directory instead of a stream
+const FormatHTML = "html"
+
+const (
+	// thumbSize is the longest side of a thumbnail in pixels
+	thumbSize = 256
+	// thumbDir is the directory of the site the thumbnails are written to
+	thumbDir = "thumbs"
+)
+
+// htmlImage is an image of a group page
+type htmlImage struct {
+	Image
+	Thumb  string
+	Date   string
+	Keeper bool
+}
+
+// htmlGroup is a group page
+type htmlGroup struct {
+	Group
+	Number int
+	Page   string
+	Images []htmlImage
+	Prev   string
+	Next   string
+}
+
+// WriteHTML writes a static site of the groups to dir: an index page linking one page per group,
+// and the thumbnails the pages show side by side. The site has no outside dependencies, so it can
+// be viewed offline.
+func WriteHTML(dir string, groups []Group) error {
+	if err := os.MkdirAll(filepath.Join(dir, thumbDir), 0755); err != nil {
+		return err
+	}
+
+	thumbs := make(map[string]string)
+	pages := make([]htmlGroup, len(groups))
+	for j, g := range groups {
+		p := htmlGroup{
+			Group:  g,
+			Number: j + 1,
+			Page:   fmt.Sprintf("group-%04d.html", j+1),
+		}
+		for _, i := range g.Images {
+			thumb, found := thumbs[i.Path]
+			if !found {
+				thumb = writeThumb(dir, i.Path)
+				thumbs[i.Path] = thumb
+			}
+			p.Images = append(p.Images, htmlImage{
+				Image:  i,
+				Thumb:  thumb,
+				Date:   exifDate(i.Path),
+				Keeper: i.Path == g.Keeper,
+			})
+		}
+		pages[j] = p
+	}
+	for j := range pages {
+		if j > 0 {
+			pages[j].Prev = pages[j-1].Page
+		}
+		if j < len(pages)-1 {
+			pages[j].Next = pages[j+1].Page
+		}
+	}
+
+	for _, p := range pages {
+		if err := writeTemplate(filepath.Join(dir, p.Page), groupTmpl, p); err != nil {
+			return err
+		}
+	}
+	return writeTemplate(filepath.Join(dir, "index.html"), indexTmpl, pages)
+}
+
+// writeThumb writes the thumbnail of an image and returns its path relative to the site, or ""
+// when the image could not be read
+func writeThumb(dir string, path string) string {
+	i, err := img.NewImage(path)
+	if err != nil {
+		log.Error(err)
+		return ""
+	}
+	t, err := i.Thumbnail(thumbSize)
+	if err != nil {
+		log.Error(err)
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(path))
+	name := filepath.Join(thumbDir, hex.EncodeToString(sum[:8])+".jpg")
+	fd, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		log.Error(err)
+		return ""
+	}
+	defer fd.Close()
+
+	if err := jpeg.Encode(fd, t, &jpeg.Options{Quality: 80}); err != nil {
+		log.Error(err)
+		return ""
+	}
+	return filepath.ToSlash(name)
+}
+
+// exifDate returns the EXIF date of an image, or "" when it has none
+func exifDate(path string) string {
+	i, err := img.NewImage(path)
+	if err != nil {
+		return ""
+	}
+	dt, err := i.ExifDateTime()
+	if err != nil || dt.IsZero() {
+		return ""
+	}
+	return dt.Format("2006-01-02 15:04:05")
+}
+
+// writeTemplate executes a template into a file
+func writeTemplate(path string, t *template.Template, data interface{}) error {
+	fd, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := t.Execute(fd, data); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+const htmlStyle = `<style>
+body { font-family: sans-serif; margin: 2em; color: #222; background: #fafafa; }
+a { color: #0366d6; }
+table { border-collapse: collapse; }
+td, th { padding: 0.3em 0.8em; text-align: left; border-bottom: 1px solid #ddd; }
+.images { display: flex; flex-wrap: wrap; gap: 1em; }
+.image { background: #fff; border: 2px solid #ddd; padding: 0.5em; width: 264px; }
+.image img { display: block; max-width: 256px; max-height: 256px; margin: 0 auto 0.5em; }
+.image.keeper { border-color: #2da44e; }
+.badge { background: #2da44e; color: #fff; padding: 0.1em 0.4em; font-size: 0.8em; }
+.path { word-break: break-all; font-family: monospace; font-size: 0.85em; }
+.nav { margin: 1em 0; }
+</style>`
+
+var indexTmpl = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>duplicate report</title>
+` + htmlStyle + `
+</head>
+<body>
+<h1>duplicate report</h1>
+{{if .}}<table>
+<tr><th>group</th><th>algorithm</th><th>fingerprint</th><th>images</th></tr>
+{{range .}}<tr><td><a href="{{.Page}}">{{.Number}}</a></td><td>{{.Algorithm}}</td><td class="path">{{.FingerPrint}}</td><td>{{len .Images}}</td></tr>
+{{end}}</table>{{else}}<p>no duplicates found</p>{{end}}
+</body>
+</html>
+`))
+
+var groupTmpl = template.Must(template.New("group").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>group {{.Number}}</title>
+` + htmlStyle + `
+</head>
+<body>
+<div class="nav"><a href="index.html">index</a>{{if .Prev}} | <a href="{{.Prev}}">previous</a>{{end}}{{if .Next}} | <a href="{{.Next}}">next</a>{{end}}</div>
+<h1>group {{.Number}}</h1>
+<p>{{.Algorithm}} <span class="path">{{.FingerPrint}}</span></p>
+<div class="images">
+{{range .Images}}<div class="image{{if .Keeper}} keeper{{end}}">
+{{if .Thumb}}<img src="{{.Thumb}}" alt="">{{else}}<p>no preview</p>{{end}}
+{{if .Keeper}}<p><span class="badge">suggested keeper</span></p>{{end}}
+<table>
+{{if .Width}}<tr><th>dimensions</th><td>{{.Width}} x {{.Height}}</td></tr>{{end}}
+<tr><th>size</th><td>{{.Size}} bytes</td></tr>
+{{if .Date}}<tr><th>date</th><td>{{.Date}}</td></tr>{{end}}
+<tr><th>distance</th><td>{{.Distance}}</td></tr>
+{{if .SameShot}}<tr><th>same shot as</th><td class="path">{{.SameShot}}</td></tr>{{end}}
+</table>
+<p class="path">{{.Path}}</p>
+</div>
+{{end}}</div>
+{{if .Pairs}}<h2>pairs</h2>
+<table>
+{{range .Pairs}}<tr><td class="path">{{.A}}</td><td class="path">{{.B}}</td><td>{{.Distance}}</td></tr>
+{{end}}</table>{{end}}
+</body>
+</html>
+`))
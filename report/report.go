@@ -0,0 +1,161 @@
+package report
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/marklap/imgdupdetect/datastore"
+	"github.com/marklap/imgdupdetect/img"
+	"github.com/marklap/imgdupdetect/keeper"
+	"github.com/marklap/imgdupdetect/match"
+)
+
+// Report formats
+const (
+	// FormatJSON writes all groups as one JSON array
+	FormatJSON = "json"
+	// FormatNDJSON writes one JSON object per group and line
+	FormatNDJSON = "ndjson"
+	// FormatCSV writes one row per image, with the group it belongs to in the first column
+	FormatCSV = "csv"
+)
+
+// Formats are the names of the supported report formats
+var Formats = []string{FormatJSON, FormatNDJSON, FormatCSV}
+
+// Image is an image of a group and what is stored about it
+type Image struct {
+	Path        string `json:"path"`
+	FingerPrint string `json:"fingerprint"`
+	Size        int64  `json:"size"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	// Distance is the number of bits its fingerprint differs from the fingerprint of the group
+	Distance int `json:"distance"`
+	// SameShot is the raw file or JPEG of the group the camera wrote for the same shot
+	SameShot string `json:"same_shot,omitempty"`
+}
+
+// Pair is two images of a near-duplicate group and the distance between their fingerprints
+type Pair struct {
+	A        string `json:"a"`
+	B        string `json:"b"`
+	Distance int    `json:"distance"`
+}
+
+// Group is a set of duplicate images
+type Group struct {
+	// FingerPrint is the hex of the lowest fingerprint of the group
+	FingerPrint string `json:"fingerprint"`
+	// Algorithm is the fingerprint algorithm the group was found with
+	Algorithm string `json:"algorithm"`
+	// Keeper is the path of the image the keeper policies suggest keeping
+	Keeper string  `json:"keeper"`
+	Images []Image `json:"images"`
+	// Pairs are the image pairs within the threshold, only for near-duplicates
+	Pairs []Pair `json:"pairs,omitempty"`
+}
+
+// Build finds the duplicate groups of a collection fingerprinted with algo and describes them
+// from the stored metadata. The threshold and searcher are passed on to match.Groups; the keeper
+// of each group is selected by keep, or keeper.Default when it is empty.
+func Build(ds *datastore.Datastore, col string, algo string, threshold int, s match.Searcher, keep keeper.Chain) ([]Group, error) {
+	groups, err := match.Groups(ds, col, threshold, s)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]Group, 0, len(groups))
+	for _, g := range groups {
+		first := g.FingerPrints[0]
+		r := Group{
+			FingerPrint: hex.EncodeToString(first),
+			Algorithm:   algo,
+			Keeper:      keeper.Choose(keep, g.Images, g.Meta),
+		}
+
+		for _, name := range g.Images {
+			fp := g.FingerPrint(name)
+			meta := g.Meta[name]
+			r.Images = append(r.Images, Image{
+				Path:        name,
+				FingerPrint: hex.EncodeToString(fp),
+				Size:        int64(datastore.Uint64Value(meta[datastore.MetaSize])),
+				Width:       int(datastore.Uint64Value(meta["width"])),
+				Height:      int(datastore.Uint64Value(meta["height"])),
+				Distance:    img.Distance(first, fp),
+				SameShot:    sameShot(name, g.Images),
+			})
+		}
+		if threshold > 0 {
+			for _, p := range g.Pairs {
+				r.Pairs = append(r.Pairs, Pair{A: p.A, B: p.B, Distance: p.Distance})
+			}
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// Write writes the groups in a format
+func Write(w io.Writer, format string, groups []Group) error {
+	switch format {
+	case FormatJSON:
+		if groups == nil {
+			groups = []Group{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(groups)
+	case FormatNDJSON:
+		enc := json.NewEncoder(w)
+		for _, g := range groups {
+			if err := enc.Encode(g); err != nil {
+				return err
+			}
+		}
+		return nil
+	case FormatCSV:
+		return writeCSV(w, groups)
+	}
+	return fmt.Errorf("unknown report format: %s", format)
+}
+
+// writeCSV writes one row per image, numbering the groups from 1
+func writeCSV(w io.Writer, groups []Group) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"group", "algorithm", "group_fingerprint", "path", "fingerprint", "size", "width", "height", "distance", "keeper", "same_shot"})
+	for j, g := range groups {
+		for _, i := range g.Images {
+			cw.Write([]string{
+				strconv.Itoa(j + 1),
+				g.Algorithm,
+				g.FingerPrint,
+				i.Path,
+				i.FingerPrint,
+				strconv.FormatInt(i.Size, 10),
+				strconv.Itoa(i.Width),
+				strconv.Itoa(i.Height),
+				strconv.Itoa(i.Distance),
+				strconv.FormatBool(i.Path == g.Keeper),
+				i.SameShot,
+			})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// sameShot returns the image of images that is the same shot as name in another format, or ""
+func sameShot(name string, images []string) string {
+	for _, other := range images {
+		if img.SameShot(name, other) {
+			return other
+		}
+	}
+	return ""
+}
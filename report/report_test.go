@@ -0,0 +1,166 @@
+package report
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/marklap/imgdupdetect/datastore"
+)
+
+var (
+	tstDatastorePath = "./testdata.dstore"
+	tstCollection    = "test"
+)
+
+func meta(size, width, height uint64) map[string][]byte {
+	m := make(map[string][]byte)
+	for k, v := range map[string]uint64{datastore.MetaSize: size, "width": width, "height": height} {
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, v)
+		m[k] = buf
+	}
+	return m
+}
+
+func TestBuild(t *testing.T) {
+	ds, err := datastore.Open(datastore.Config{Path: tstDatastorePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tstDatastorePath)
+	defer ds.Close()
+
+	for _, tst := range []struct {
+		fp   []byte
+		name string
+	}{
+		{[]byte{0x00, 0x00}, "a.jpg"},
+		{[]byte{0x00, 0x00}, "b.jpg"},
+		{[]byte{0x00, 0x03}, "c.jpg"},
+		{[]byte{0xff, 0xff}, "d.jpg"},
+	} {
+		if err := ds.Add(tstCollection, tst.fp, tst.name, meta(100, 20, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	groups, err := Build(ds, tstCollection, "dhash", 2, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 {
+		t.Fatalf("group count mismatch - want: 1, got: %d", len(groups))
+	}
+	g := groups[0]
+	if g.FingerPrint != "0000" || g.Algorithm != "dhash" {
+		t.Errorf("group mismatch - want: 0000 dhash, got: %s %s", g.FingerPrint, g.Algorithm)
+	}
+	want := Image{Path: "c.jpg", FingerPrint: "0003", Size: 100, Width: 20, Height: 10, Distance: 2}
+	if len(g.Images) != 3 || g.Images[2] != want {
+		t.Errorf("image mismatch - want: %v, got: %v", want, g.Images)
+	}
+	if len(g.Pairs) != 3 {
+		t.Errorf("pair count mismatch - want: 3, got: %d", len(g.Pairs))
+	}
+
+	groups, err = Build(ds, tstCollection, "dhash", 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || len(groups[0].Images) != 2 || groups[0].Pairs != nil {
+		t.Errorf("exact groups mismatch - want: one group of 2 without pairs, got: %v", groups)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	groups := []Group{
+		{FingerPrint: "00", Algorithm: "phash", Keeper: "b,c.jpg", Images: []Image{{Path: "a.jpg", FingerPrint: "00"}, {Path: "b,c.jpg", FingerPrint: "01", Distance: 1}}},
+		{FingerPrint: "ff", Algorithm: "phash", Images: []Image{{Path: "d.jpg", FingerPrint: "ff"}, {Path: "e.jpg", FingerPrint: "ff"}}},
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, FormatJSON, groups); err != nil {
+		t.Fatal(err)
+	}
+	var got []Group
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Images[1].Path != "b,c.jpg" {
+		t.Errorf("json mismatch - got: %s", buf.String())
+	}
+
+	buf.Reset()
+	if err := Write(&buf, FormatNDJSON, groups); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 2 {
+		t.Errorf("ndjson line count mismatch - want: 2, got: %d", len(lines))
+	}
+
+	buf.Reset()
+	if err := Write(&buf, FormatCSV, groups); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 5 {
+		t.Errorf("csv line count mismatch - want: 5, got: %d", len(lines))
+	}
+	if want := `1,phash,00,"b,c.jpg",01,0,0,0,1,true,`; len(lines) > 2 && lines[2] != want {
+		t.Errorf("csv row mismatch - want: %s, got: %s", want, lines[2])
+	}
+
+	buf.Reset()
+	if err := Write(&buf, FormatJSON, nil); err != nil || strings.TrimSpace(buf.String()) != "[]" {
+		t.Errorf("empty json mismatch - want: [], got: %s (%v)", buf.String(), err)
+	}
+
+	if err := Write(&buf, "xml", groups); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
+
+func TestWriteHTML(t *testing.T) {
+	dir, err := os.MkdirTemp("", "imgdd-report-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	groups := []Group{
+		{FingerPrint: "00", Algorithm: "phash", Keeper: "/missing/<b>.jpg", Images: []Image{
+			{Path: "/missing/a.jpg", Size: 10, Width: 100, Height: 100},
+			{Path: "/missing/<b>.jpg", Size: 20, Width: 200, Height: 100},
+		}},
+	}
+	if err := WriteHTML(dir, groups); err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := os.ReadFile(filepath.Join(dir, "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(index), `href="group-0001.html"`) {
+		t.Errorf("index does not link the group page: %s", index)
+	}
+
+	page, err := os.ReadFile(filepath.Join(dir, "group-0001.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(page), "<b>.jpg") || !strings.Contains(string(page), "&lt;b&gt;.jpg") {
+		t.Error("path not escaped")
+	}
+	if strings.Count(string(page), `class="image keeper"`) != 1 {
+		t.Error("want exactly one suggested keeper")
+	}
+	if strings.Contains(string(page), "http") {
+		t.Error("page depends on a remote resource")
+	}
+}
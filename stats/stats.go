@@ -2,16 +2,20 @@ package stats
 
 import (
 	"fmt"
+	"sync/atomic"
 	"time"
 )
 
-// ScanStats holds statistics of the images processed
+// ScanStats holds statistics of the images processed. The counters may be updated from many
+// goroutines at once through the Add methods.
 type ScanStats struct {
 	Start            time.Time
 	End              time.Time
-	ImagesFound      int
-	FingerPrintCount int
-	DuplicatesFound  int
+	ImagesFound      int64
+	Skipped          int64
+	ContentHashCount int64
+	FingerPrintCount int64
+	DuplicatesFound  int64
 }
 
 // NewScanStats creates a new Statistics object
@@ -19,13 +23,38 @@ func NewScanStats() *ScanStats {
 	return &ScanStats{Start: time.Now()}
 }
 
+// AddImagesFound adds to the number of images found
+func (s *ScanStats) AddImagesFound(n int) {
+	atomic.AddInt64(&s.ImagesFound, int64(n))
+}
+
+// AddSkipped adds to the number of images skipped because they did not change since the last scan
+func (s *ScanStats) AddSkipped(n int) {
+	atomic.AddInt64(&s.Skipped, int64(n))
+}
+
+// AddContentHashCount adds to the number of files whose content was hashed
+func (s *ScanStats) AddContentHashCount(n int) {
+	atomic.AddInt64(&s.ContentHashCount, int64(n))
+}
+
+// AddFingerPrintCount adds to the number of images fingerprinted
+func (s *ScanStats) AddFingerPrintCount(n int) {
+	atomic.AddInt64(&s.FingerPrintCount, int64(n))
+}
+
+// AddDuplicatesFound adds to the number of duplicates found
+func (s *ScanStats) AddDuplicatesFound(n int) {
+	atomic.AddInt64(&s.DuplicatesFound, int64(n))
+}
+
 // Complete sets the end time of the scan
 func (s *ScanStats) Complete() {
 	s.End = time.Now()
 }
 
 // Duration returns the time it took to run the scan
-func (s ScanStats) Duration() time.Duration {
+func (s *ScanStats) Duration() time.Duration {
 	if s.End.IsZero() {
 		return time.Duration(0)
 	}
@@ -33,16 +62,18 @@ func (s ScanStats) Duration() time.Duration {
 }
 
 // Rate returns the average time it takes to find, fingerprint and companre an image
-func (s ScanStats) Rate() time.Duration {
+func (s *ScanStats) Rate() time.Duration {
 	d := s.Duration()
-	if d == 0 {
-		return d
+	n := atomic.LoadInt64(&s.FingerPrintCount)
+	if d == 0 || n == 0 {
+		return 0
 	}
-	return time.Duration(uint64(d) / uint64(s.FingerPrintCount))
+	return time.Duration(uint64(d) / uint64(n))
 }
 
 // String returns a printable string of stats
-func (s ScanStats) String() string {
-	return fmt.Sprintf("scanning took %s (avg %s/image); found %d images; fingerprinted %d images; %d duplicates found",
-		s.Duration(), s.Rate(), s.ImagesFound, s.FingerPrintCount, s.DuplicatesFound)
+func (s *ScanStats) String() string {
+	return fmt.Sprintf("scanning took %s (avg %s/image); found %d images; skipped %d unchanged; hashed %d files; fingerprinted %d images; %d duplicates found",
+		s.Duration(), s.Rate(), atomic.LoadInt64(&s.ImagesFound), atomic.LoadInt64(&s.Skipped), atomic.LoadInt64(&s.ContentHashCount),
+		atomic.LoadInt64(&s.FingerPrintCount), atomic.LoadInt64(&s.DuplicatesFound))
 }